@@ -0,0 +1,60 @@
+// Command jwtkey generates a JWT signing key in the layout the server reads
+// from JWT_KEYS_DIR: a PKCS#8 PEM file named <kid>.pem.
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func main() {
+	alg := flag.String("alg", "EdDSA", "key algorithm: EdDSA or RS256")
+	dir := flag.String("dir", "keys", "directory to write the key to")
+	flag.Parse()
+
+	var key crypto.Signer
+	var err error
+	switch *alg {
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		log.Fatalf("Unknown algorithm %q", *alg)
+	}
+	if err != nil {
+		log.Fatal("Error generating key: ", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		log.Fatal("Error encoding key: ", err)
+	}
+
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Fatal("Error generating key id: ", err)
+	}
+	kid := time.Now().Format("20060102") + "-" + hex.EncodeToString(suffix)
+
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		log.Fatal("Error creating directory: ", err)
+	}
+	path := filepath.Join(*dir, kid+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		log.Fatal("Error writing key: ", err)
+	}
+
+	fmt.Println(kid)
+}
@@ -3,33 +3,174 @@ package main
 import (
 	"auth-register-sistem/internal/config"
 	"auth-register-sistem/internal/handler"
+	"auth-register-sistem/internal/jwtauth"
+	"auth-register-sistem/internal/mailer"
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/oidc"
+	"auth-register-sistem/internal/password"
 	"auth-register-sistem/internal/repository"
 	"auth-register-sistem/internal/routes"
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joho/godotenv"
+	"github.com/shopspring/decimal"
 )
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	// Keep quantities as JSON numbers, as they were when they were ints
+	decimal.MarshalJSONWithoutQuotes = true
+
+	// .env is optional; its variables never override the environment
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal("Error loading .env file: ", err)
+	}
+
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatal("Invalid configuration:\n", err)
 	}
+	log.Print("Effective configuration:\n", cfg.Dump())
 
-	dbCfg := config.NewDBConfig()
-	dbConn, err := config.SetupDb(dbCfg)
+	dbConn, err := config.SetupDb(&cfg.DB)
 	if err != nil {
 		log.Fatal("Error connecting to database", err)
 	}
 	defer dbConn.Close()
 	log.Println("Connected to database")
+
+	passwordPolicy, err := password.NewPolicy(&cfg.Password)
+	if err != nil {
+		log.Fatal("Error loading password policy: ", err)
+	}
+
+	jwtManager, err := jwtauth.New(&cfg.JWT)
+	if err != nil {
+		log.Fatal("Error loading JWT keys: ", err)
+	}
+
+	var oidcProviders []*oidc.Provider
+	for _, providerCfg := range cfg.OIDC {
+		provider, err := oidc.NewProvider(providerCfg)
+		if err != nil {
+			log.Fatal("Error configuring OIDC: ", err)
+		}
+		oidcProviders = append(oidcProviders, provider)
+	}
+
+	mail, err := mailer.New(&cfg.Mail)
+	if err != nil {
+		log.Fatal("Error configuring mailer: ", err)
+	}
+	// Emails go out from a background worker so responses never wait on
+	// the relay
+	mailQueue := mailer.NewQueue(mail, 100)
+
 	userRepo := repository.NewUserRepository(dbConn)
+	tokenRepo := repository.NewTokenRepository(dbConn)
+	authAttemptRepo := repository.NewAuthAttemptRepository(dbConn)
+	mfaRepo := repository.NewMFARepository(dbConn)
+	apiKeyRepo := repository.NewAPIKeyRepository(dbConn)
+	oidcRepo := repository.NewOIDCRepository(dbConn)
+	orgRepo := repository.NewOrgRepository(dbConn)
 	stockRepo := repository.NewStockRepository(dbConn)
 	transactionRepo := repository.NewTransactionRepository(dbConn)
-	userHandler := handler.NewUserHandler(userRepo)
+	returnRepo := repository.NewReturnRepository(dbConn)
+	bomRepo := repository.NewBOMRepository(dbConn)
+	priceListRepo := repository.NewPriceListRepository(dbConn)
+	reportRepo := repository.NewReportRepository(dbConn)
+	auditRepo := repository.NewAuditRepository(dbConn)
+
+	// The platform admin is named by configuration, never by who
+	// registers first
+	if cfg.Admin.Email != "" {
+		err := userRepo.PromoteAdmin(context.Background(), cfg.Admin.Email, audit.Actor{})
+		if errors.Is(err, repository.ErrNotFound) {
+			log.Println("No account has verified the admin email", cfg.Admin.Email, "yet; restart once it has to make it an admin")
+		} else if err != nil {
+			log.Fatal("Error promoting the admin: ", err)
+		}
+	}
+	userHandler := handler.NewUserHandler(userRepo, tokenRepo, authAttemptRepo, mfaRepo, orgRepo, jwtManager, passwordPolicy, mailQueue, &cfg.Mail, &cfg.Login)
 	stockHandler := handler.NewStockHandler(stockRepo)
 	transactionHandler := handler.NewTransactionHandler(transactionRepo)
+	returnHandler := handler.NewReturnHandler(returnRepo)
+	bomHandler := handler.NewBOMHandler(bomRepo)
+	priceListHandler := handler.NewPriceListHandler(priceListRepo)
+	reportHandler := handler.NewReportHandler(reportRepo)
+	apiKeyHandler := handler.NewAPIKeyHandler(apiKeyRepo)
+	jwksHandler := handler.NewJWKSHandler(jwtManager)
+	oidcHandler := handler.NewOIDCHandler(oidcProviders, oidcRepo, userHandler)
+	orgHandler := handler.NewOrgHandler(orgRepo, userHandler)
+	auditHandler := handler.NewAuditHandler(auditRepo)
+
+	authenticator := middleware.NewAuthenticator(userRepo, apiKeyRepo, orgRepo, jwtManager)
+
+	mux := routes.SetupRoutes(authenticator, userHandler, stockHandler, transactionHandler, returnHandler, bomHandler, priceListHandler, reportHandler, apiKeyHandler, jwksHandler, oidcHandler, orgHandler, auditHandler)
+	serverCfg := cfg.Server
+
+	// Requests run under baseCtx, so the ones still running when the
+	// shutdown deadline passes can be cancelled and their transactions
+	// rolled back
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server := &http.Server{
+		Addr:              serverCfg.Addr,
+		Handler:           middleware.RequestID(cfg.Login.TrustProxy, middleware.Deadline(serverCfg.RequestTimeout, mux)),
+		ReadHeaderTimeout: serverCfg.ReadHeaderTimeout,
+		ReadTimeout:       serverCfg.ReadTimeout,
+		WriteTimeout:      serverCfg.WriteTimeout,
+		IdleTimeout:       serverCfg.IdleTimeout,
+		MaxHeaderBytes:    serverCfg.MaxHeaderBytes,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
 
-	mux := routes.SetupRoutes(userHandler, stockHandler, transactionHandler)
-	log.Println("Server started on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	stopped, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Println("Server listening on", serverCfg.Addr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		// os.Exit skips the deferred calls, so release the database pool
+		// first
+		log.Println("Error starting server: ", err)
+		dbConn.Close()
+		os.Exit(1)
+	case <-stopped.Done():
+	}
+	stop()
+
+	// Stop accepting connections and let in-flight requests finish. The
+	// database pool is closed by the deferred Close once they are done.
+	log.Println("Shutting down, waiting up to", serverCfg.ShutdownTimeout, "for in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverCfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Shutdown deadline passed, cancelling remaining requests: ", err)
+		cancelRequests()
+		server.Close()
+	}
+	// The mail queue gets its own deadline, so slow requests cannot use up
+	// the time its emails need
+	mailCtx, cancelMail := context.WithTimeout(context.Background(), cfg.Mail.DrainTimeout)
+	defer cancelMail()
+	if err := mailQueue.Close(mailCtx); err != nil {
+		log.Println("Mail drain deadline passed before the queue emptied: ", err)
+	}
+	log.Println("Server stopped")
 }
\ No newline at end of file
@@ -3,13 +3,11 @@ module auth-register-sistem
 go 1.25.1
 
 require (
+	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/google/uuid v1.6.0
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
+	github.com/shopspring/decimal v1.4.0
 	golang.org/x/crypto v0.42.0
-)
-
-require (
-	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
-	golang.org/x/sys v0.36.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
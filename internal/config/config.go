@@ -4,33 +4,148 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
+// DBConfig is the PostgreSQL connection and its pool
 type DBConfig struct {
-	Host     string
-	Username string
-	Password string
-	Database string
-	Port     string
+	Host     string `yaml:"host"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Database string `yaml:"database"`
+	Port     string `yaml:"port"`
+	// SSLMode is one of the modes lib/pq supports: disable, require,
+	// verify-ca or verify-full.
+	SSLMode string `yaml:"sslmode"`
+	// MaxOpenConns caps the pool, zero meaning unlimited; at most
+	// MaxIdleConns of them are kept open while unused.
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	// LockTimeout bounds how long a statement waits for rows locked by
+	// another transaction, such as a stock row taken FOR UPDATE; zero
+	// waits forever.
+	LockTimeout time.Duration `yaml:"lock_timeout"`
 }
 
-func NewDBConfig() *DBConfig {
-	return &DBConfig{
-		Host:     os.Getenv("DB_HOST"),
-		Username: os.Getenv("DB_USERNAME"),
-		Password: os.Getenv("DB_PASSWORD"),
-		Database: os.Getenv("DB_DATABASE"),
-		Port:     os.Getenv("DB_PORT"),
-	}
+// ServerConfig holds the address and limits of the HTTP server.
+// RequestTimeout is the deadline of each request, after which its database
+// queries are cancelled; zero leaves requests unbounded. WriteTimeout should
+// be longer, so a request that runs out of time can still send its error.
+type ServerConfig struct {
+	Addr              string        `yaml:"addr"`
+	RequestTimeout    time.Duration `yaml:"request_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+	// ShutdownTimeout is how long in-flight requests get to finish on
+	// SIGTERM before they are cancelled.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// PasswordConfig is the password policy applied on registration and
+// password changes.
+type PasswordConfig struct {
+	MinLength     int  `yaml:"min_length"`
+	RequireUpper  bool `yaml:"require_upper"`
+	RequireLower  bool `yaml:"require_lower"`
+	RequireDigit  bool `yaml:"require_digit"`
+	RequireSymbol bool `yaml:"require_symbol"`
+	// BreachedList is the path of a file with one known-breached password
+	// per line; empty disables the check.
+	BreachedList string `yaml:"breached_list"`
+}
+
+// MailConfig selects and configures the mailer. Driver is "smtp" or "log";
+// the log driver appends messages to LogFile, or the server log if empty.
+type MailConfig struct {
+	Driver       string `yaml:"driver"`
+	From         string `yaml:"from"`
+	SMTPHost     string `yaml:"smtp_host"`
+	SMTPPort     string `yaml:"smtp_port"`
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	LogFile      string `yaml:"log_file"`
+	// AppURL is the public base URL of this server. The links of account
+	// emails point at its GET /email/verify and GET /password/reset.
+	AppURL string `yaml:"app_url"`
+	// RequireVerification blocks login until the email is verified.
+	RequireVerification bool `yaml:"require_verification"`
+	// How long the links of account emails stay valid
+	PasswordResetTTL     time.Duration `yaml:"password_reset_ttl"`
+	EmailVerificationTTL time.Duration `yaml:"email_verification_ttl"`
+	// DrainTimeout is how long queued emails get to go out on SIGTERM,
+	// counted after in-flight requests have finished
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+// LoginConfig limits password guessing. Each failure doubles the delay
+// before the next answer, up to MaxDelay; an account is locked for
+// Lockout after MaxFailures consecutive failures, and an IP is refused
+// after IPMaxFailures failures within IPWindow.
+type LoginConfig struct {
+	MaxFailures   int           `yaml:"max_failures"`
+	Lockout       time.Duration `yaml:"lockout"`
+	IPMaxFailures int           `yaml:"ip_max_failures"`
+	IPWindow      time.Duration `yaml:"ip_window"`
+	BaseDelay     time.Duration `yaml:"delay_base"`
+	MaxDelay      time.Duration `yaml:"delay_max"`
+	// TrustProxy takes the client IP from the last X-Forwarded-For entry,
+	// the one added by the single proxy in front of the server
+	TrustProxy bool `yaml:"trust_proxy"`
+	// MFAIssuer names the service in authenticator apps
+	MFAIssuer string `yaml:"mfa_issuer"`
+	// MFAChallengeTTL is how long a password login waits for its MFA code
+	MFAChallengeTTL time.Duration `yaml:"mfa_challenge_ttl"`
+}
+
+// AdminConfig names the platform admin. Accounts are created with the user
+// role; the account whose verified email is Email is made an admin at
+// startup, so a fresh deployment is not handed to whoever registers first.
+type AdminConfig struct {
+	Email string `yaml:"email"`
+}
+
+// JWTConfig selects the keys tokens are signed with and the standard
+// claims they carry. See the jwtauth package for the keys directory layout.
+type JWTConfig struct {
+	KeysDir    string        `yaml:"keys_dir"`
+	SigningKID string        `yaml:"signing_kid"`
+	Issuer     string        `yaml:"issuer"`
+	Audience   string        `yaml:"audience"`
+	AccessTTL  time.Duration `yaml:"ttl"`
+	// AllowEphemeralKey lets the server start without KeysDir, signing
+	// with a key generated at startup. Tokens stop verifying on restart
+	// and across replicas, so it is only meant for development.
+	AllowEphemeralKey bool `yaml:"allow_ephemeral_key"`
+	// LegacySecret still verifies HS256 tokens issued before the switch
+	// to asymmetric keys; unset it once those have expired.
+	LegacySecret string `yaml:"legacy_secret"`
+}
+
+// OIDCProviderConfig is an OpenID Connect provider users can sign in with.
+// Its endpoints are read from the issuer's discovery document.
+type OIDCProviderConfig struct {
+	Name         string   `yaml:"name"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	Scopes       []string `yaml:"scopes"`
 }
 
 func SetupDb(cfg *DBConfig) (*sql.DB, error) {
+	// lock_timeout is sent as a run-time parameter, so it applies to every
+	// connection of the pool
 	connStr := fmt.Sprintf(
-		"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
-		cfg.Host, cfg.Username, cfg.Password, cfg.Database, cfg.Port,
+		"host=%s user=%s password=%s dbname=%s port=%s sslmode=%s lock_timeout=%d",
+		quoteConnValue(cfg.Host), quoteConnValue(cfg.Username), quoteConnValue(cfg.Password),
+		quoteConnValue(cfg.Database), quoteConnValue(cfg.Port), cfg.SSLMode, cfg.LockTimeout.Milliseconds(),
 	)
 
 	dbConn, err := sql.Open("postgres", connStr)
@@ -38,6 +153,10 @@ func SetupDb(cfg *DBConfig) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
+	dbConn.SetMaxOpenConns(cfg.MaxOpenConns)
+	dbConn.SetMaxIdleConns(cfg.MaxIdleConns)
+	dbConn.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
 	if err := dbConn.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
@@ -58,7 +177,7 @@ func SetupDb(cfg *DBConfig) (*sql.DB, error) {
 		CREATE TABLE IF NOT EXISTS stock (
 			ID UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
 			NAME TEXT NOT NULL,
-			QUANTITY INTEGER NOT NULL,
+			QUANTITY NUMERIC(20,6) NOT NULL,
 			CREATED_AT TIMESTAMP DEFAULT now(),
 			UPDATED_AT TIMESTAMP DEFAULT now(),
 			CREATED_BY UUID REFERENCES users(ID)
@@ -67,12 +186,307 @@ func SetupDb(cfg *DBConfig) (*sql.DB, error) {
 		CREATE TABLE IF NOT EXISTS transactions (
 			ID UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
 			NAME TEXT NOT NULL,
-			QUANTITY INTEGER NOT NULL,
+			QUANTITY NUMERIC(20,6) NOT NULL,
 			TYPE VARCHAR(10) NOT NULL,
 			CREATED_AT TIMESTAMP DEFAULT now(),
 			UPDATED_AT TIMESTAMP DEFAULT now(),
 			CREATED_BY UUID REFERENCES users(ID)
-		)
+		);
+
+		ALTER TABLE transactions ADD COLUMN IF NOT EXISTS REFERENCE_ID UUID;
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS QUARANTINED_QUANTITY NUMERIC(20,6) NOT NULL DEFAULT 0;
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS SKU TEXT UNIQUE;
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS PARENT_ID UUID REFERENCES stock(ID);
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS ATTRIBUTES JSONB NOT NULL DEFAULT '{}';
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS BASE_UNIT TEXT NOT NULL DEFAULT 'unit';
+		ALTER TABLE transactions ADD COLUMN IF NOT EXISTS UNIT TEXT NOT NULL DEFAULT '';
+		ALTER TABLE transactions ADD COLUMN IF NOT EXISTS UNIT_QUANTITY NUMERIC(20,6);
+
+		CREATE TABLE IF NOT EXISTS product_units (
+			PRODUCT_ID UUID NOT NULL REFERENCES stock(ID) ON DELETE CASCADE,
+			NAME TEXT NOT NULL,
+			FACTOR NUMERIC(20,6) NOT NULL CHECK (FACTOR > 0),
+			PRIMARY KEY (PRODUCT_ID, NAME)
+		);
+
+		CREATE TABLE IF NOT EXISTS returns (
+			ID UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			TRANSACTION_ID UUID NOT NULL REFERENCES transactions(ID),
+			NAME TEXT NOT NULL,
+			QUANTITY NUMERIC(20,6) NOT NULL,
+			RESTOCKED NUMERIC(20,6) NOT NULL DEFAULT 0,
+			SCRAPPED NUMERIC(20,6) NOT NULL DEFAULT 0,
+			QUARANTINED NUMERIC(20,6) NOT NULL DEFAULT 0,
+			REASON TEXT NOT NULL DEFAULT '',
+			CREATED_AT TIMESTAMP DEFAULT now(),
+			CREATED_BY UUID REFERENCES users(ID)
+		);
+
+		CREATE TABLE IF NOT EXISTS bom_components (
+			KIT_ID UUID NOT NULL REFERENCES stock(ID) ON DELETE CASCADE,
+			COMPONENT_ID UUID NOT NULL REFERENCES stock(ID),
+			QUANTITY NUMERIC(20,6) NOT NULL CHECK (QUANTITY > 0),
+			PRIMARY KEY (KIT_ID, COMPONENT_ID)
+		);
+
+		CREATE TABLE IF NOT EXISTS kit_operations (
+			ID UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			KIT_ID UUID NOT NULL REFERENCES stock(ID),
+			TYPE VARCHAR(20) NOT NULL,
+			QUANTITY NUMERIC(20,6) NOT NULL,
+			CREATED_AT TIMESTAMP DEFAULT now(),
+			CREATED_BY UUID REFERENCES users(ID)
+		);
+
+		-- Quantities used to be whole numbers; widen existing columns to
+		-- exact decimals. These are no-ops once the columns are NUMERIC.
+		ALTER TABLE stock ALTER COLUMN QUANTITY TYPE NUMERIC(20,6);
+		ALTER TABLE stock ALTER COLUMN QUARANTINED_QUANTITY TYPE NUMERIC(20,6);
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS PRECISION INTEGER NOT NULL DEFAULT 0 CHECK (PRECISION BETWEEN 0 AND 6);
+		ALTER TABLE transactions ALTER COLUMN QUANTITY TYPE NUMERIC(20,6);
+		ALTER TABLE transactions ALTER COLUMN UNIT_QUANTITY TYPE NUMERIC(20,6);
+		ALTER TABLE product_units ALTER COLUMN FACTOR TYPE NUMERIC(20,6);
+		ALTER TABLE returns ALTER COLUMN QUANTITY TYPE NUMERIC(20,6);
+		ALTER TABLE returns ALTER COLUMN RESTOCKED TYPE NUMERIC(20,6);
+		ALTER TABLE returns ALTER COLUMN SCRAPPED TYPE NUMERIC(20,6);
+		ALTER TABLE returns ALTER COLUMN QUARANTINED TYPE NUMERIC(20,6);
+		ALTER TABLE bom_components ALTER COLUMN QUANTITY TYPE NUMERIC(20,6);
+		ALTER TABLE kit_operations ALTER COLUMN QUANTITY TYPE NUMERIC(20,6);
+
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS CURRENCY CHAR(3) NOT NULL DEFAULT 'BRL';
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS SALE_PRICE NUMERIC(20,4);
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS COST_PRICE NUMERIC(20,4);
+		ALTER TABLE transactions ADD COLUMN IF NOT EXISTS UNIT_PRICE NUMERIC(20,4);
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS VERSION INTEGER NOT NULL DEFAULT 1;
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS DELETED_AT TIMESTAMP;
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS ARCHIVED_AT TIMESTAMP;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS ROLE VARCHAR(20) NOT NULL DEFAULT 'user';
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS DISABLED_AT TIMESTAMP;
+
+		CREATE TABLE IF NOT EXISTS price_lists (
+			ID UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			NAME TEXT NOT NULL,
+			CURRENCY CHAR(3) NOT NULL,
+			VALID_FROM TIMESTAMP,
+			VALID_TO TIMESTAMP,
+			CREATED_AT TIMESTAMP DEFAULT now(),
+			CREATED_BY UUID REFERENCES users(ID),
+			CHECK (VALID_FROM IS NULL OR VALID_TO IS NULL OR VALID_FROM < VALID_TO)
+		);
+
+		CREATE TABLE IF NOT EXISTS price_list_items (
+			PRICE_LIST_ID UUID NOT NULL REFERENCES price_lists(ID) ON DELETE CASCADE,
+			PRODUCT_ID UUID NOT NULL REFERENCES stock(ID) ON DELETE CASCADE,
+			PRICE NUMERIC(20,4) NOT NULL CHECK (PRICE >= 0),
+			PRIMARY KEY (PRICE_LIST_ID, PRODUCT_ID)
+		);
+
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS EMAIL_VERIFIED_AT TIMESTAMP;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS FAILED_LOGINS INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS LOCKED_UNTIL TIMESTAMP;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS MFA_SECRET TEXT;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS MFA_ENABLED_AT TIMESTAMP;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS MFA_LAST_COUNTER BIGINT;
+
+		CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+			USER_ID UUID NOT NULL REFERENCES users(ID) ON DELETE CASCADE,
+			CODE_HASH CHAR(64) NOT NULL,
+			USED_AT TIMESTAMP,
+			PRIMARY KEY (USER_ID, CODE_HASH)
+		);
+
+		CREATE TABLE IF NOT EXISTS user_tokens (
+			ID UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			USER_ID UUID NOT NULL REFERENCES users(ID) ON DELETE CASCADE,
+			PURPOSE VARCHAR(30) NOT NULL,
+			TOKEN_HASH CHAR(64) UNIQUE NOT NULL,
+			EXPIRES_AT TIMESTAMP NOT NULL,
+			USED_AT TIMESTAMP,
+			CREATED_AT TIMESTAMP DEFAULT now()
+		);
+
+		CREATE TABLE IF NOT EXISTS auth_attempts (
+			ID UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			USERNAME TEXT NOT NULL,
+			USER_ID UUID REFERENCES users(ID) ON DELETE SET NULL,
+			IP TEXT NOT NULL,
+			USER_AGENT TEXT NOT NULL DEFAULT '',
+			SUCCESS BOOLEAN NOT NULL,
+			REASON VARCHAR(30) NOT NULL,
+			CREATED_AT TIMESTAMP DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS auth_attempts_ip_idx ON auth_attempts (IP, CREATED_AT);
+		CREATE INDEX IF NOT EXISTS auth_attempts_username_idx ON auth_attempts (USERNAME, CREATED_AT);
+
+		CREATE TABLE IF NOT EXISTS api_keys (
+			ID UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			NAME TEXT NOT NULL,
+			PREFIX CHAR(8) UNIQUE NOT NULL,
+			KEY_HASH CHAR(64) NOT NULL,
+			SCOPES TEXT[] NOT NULL DEFAULT '{}',
+			CREATED_BY UUID REFERENCES users(ID) ON DELETE SET NULL,
+			CREATED_AT TIMESTAMP DEFAULT now(),
+			LAST_USED_AT TIMESTAMP,
+			EXPIRES_AT TIMESTAMP,
+			REVOKED_AT TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS user_identities (
+			PROVIDER TEXT NOT NULL,
+			SUBJECT TEXT NOT NULL,
+			USER_ID UUID NOT NULL REFERENCES users(ID) ON DELETE CASCADE,
+			EMAIL TEXT NOT NULL DEFAULT '',
+			CREATED_AT TIMESTAMP DEFAULT now(),
+			LAST_LOGIN_AT TIMESTAMP,
+			PRIMARY KEY (PROVIDER, SUBJECT)
+		);
+
+		CREATE TABLE IF NOT EXISTS oidc_login_states (
+			STATE_HASH CHAR(64) PRIMARY KEY,
+			PROVIDER TEXT NOT NULL,
+			NONCE TEXT NOT NULL,
+			CODE_VERIFIER TEXT NOT NULL,
+			EXPIRES_AT TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS organizations (
+			ID UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			NAME TEXT NOT NULL,
+			SLUG VARCHAR(50) UNIQUE NOT NULL,
+			CREATED_AT TIMESTAMP DEFAULT now()
+		);
+
+		CREATE TABLE IF NOT EXISTS org_members (
+			ORG_ID UUID NOT NULL REFERENCES organizations(ID) ON DELETE CASCADE,
+			USER_ID UUID NOT NULL REFERENCES users(ID) ON DELETE CASCADE,
+			ROLE VARCHAR(20) NOT NULL DEFAULT 'member',
+			CREATED_AT TIMESTAMP DEFAULT now(),
+			PRIMARY KEY (ORG_ID, USER_ID)
+		);
+		CREATE INDEX IF NOT EXISTS org_members_user_idx ON org_members (USER_ID);
+
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS ORG_ID UUID REFERENCES organizations(ID);
+		ALTER TABLE transactions ADD COLUMN IF NOT EXISTS ORG_ID UUID REFERENCES organizations(ID);
+		ALTER TABLE returns ADD COLUMN IF NOT EXISTS ORG_ID UUID REFERENCES organizations(ID);
+		ALTER TABLE kit_operations ADD COLUMN IF NOT EXISTS ORG_ID UUID REFERENCES organizations(ID);
+		ALTER TABLE price_lists ADD COLUMN IF NOT EXISTS ORG_ID UUID REFERENCES organizations(ID);
+		ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS ORG_ID UUID REFERENCES organizations(ID);
+
+		-- Data from before organizations existed is moved to a "default"
+		-- organization that every existing user joins, admins as its admins
+		DO $$
+		BEGIN
+			IF EXISTS (SELECT 1 FROM stock WHERE ORG_ID IS NULL)
+				OR EXISTS (SELECT 1 FROM transactions WHERE ORG_ID IS NULL)
+				OR EXISTS (SELECT 1 FROM returns WHERE ORG_ID IS NULL)
+				OR EXISTS (SELECT 1 FROM kit_operations WHERE ORG_ID IS NULL)
+				OR EXISTS (SELECT 1 FROM price_lists WHERE ORG_ID IS NULL)
+				OR EXISTS (SELECT 1 FROM api_keys WHERE ORG_ID IS NULL) THEN
+				INSERT INTO organizations (ID, NAME, SLUG)
+				VALUES ('00000000-0000-0000-0000-000000000001', 'Default', 'default')
+				ON CONFLICT DO NOTHING;
+				INSERT INTO org_members (ORG_ID, USER_ID, ROLE)
+				SELECT '00000000-0000-0000-0000-000000000001', ID, CASE WHEN ROLE = 'admin' THEN 'admin' ELSE 'member' END
+				FROM users
+				ON CONFLICT DO NOTHING;
+				UPDATE stock SET ORG_ID = '00000000-0000-0000-0000-000000000001' WHERE ORG_ID IS NULL;
+				UPDATE transactions SET ORG_ID = '00000000-0000-0000-0000-000000000001' WHERE ORG_ID IS NULL;
+				UPDATE returns SET ORG_ID = '00000000-0000-0000-0000-000000000001' WHERE ORG_ID IS NULL;
+				UPDATE kit_operations SET ORG_ID = '00000000-0000-0000-0000-000000000001' WHERE ORG_ID IS NULL;
+				UPDATE price_lists SET ORG_ID = '00000000-0000-0000-0000-000000000001' WHERE ORG_ID IS NULL;
+				UPDATE api_keys SET ORG_ID = '00000000-0000-0000-0000-000000000001' WHERE ORG_ID IS NULL;
+			END IF;
+		END $$;
+
+		ALTER TABLE stock ALTER COLUMN ORG_ID SET NOT NULL;
+		ALTER TABLE transactions ALTER COLUMN ORG_ID SET NOT NULL;
+		ALTER TABLE returns ALTER COLUMN ORG_ID SET NOT NULL;
+		ALTER TABLE kit_operations ALTER COLUMN ORG_ID SET NOT NULL;
+		ALTER TABLE price_lists ALTER COLUMN ORG_ID SET NOT NULL;
+		ALTER TABLE api_keys ALTER COLUMN ORG_ID SET NOT NULL;
+		CREATE INDEX IF NOT EXISTS stock_org_idx ON stock (ORG_ID, NAME);
+		CREATE INDEX IF NOT EXISTS transactions_org_idx ON transactions (ORG_ID, CREATED_AT);
+
+		-- SKUs only need to be unique within an organization
+		ALTER TABLE stock DROP CONSTRAINT IF EXISTS stock_sku_key;
+		CREATE UNIQUE INDEX IF NOT EXISTS stock_org_sku_key ON stock (ORG_ID, SKU);
+
+		-- Append-only log of changes. Rows have no foreign keys so they
+		-- outlive what they describe, and each HASH covers the row and the
+		-- HASH before it.
+		CREATE TABLE IF NOT EXISTS audit_log (
+			ID BIGSERIAL PRIMARY KEY,
+			ORG_ID UUID,
+			ACTOR_ID UUID,
+			API_KEY_ID UUID,
+			ACTION VARCHAR(30) NOT NULL,
+			ENTITY_TYPE VARCHAR(30) NOT NULL,
+			ENTITY_ID TEXT NOT NULL,
+			BEFORE JSONB,
+			AFTER JSONB,
+			REQUEST_ID TEXT NOT NULL DEFAULT '',
+			IP TEXT NOT NULL DEFAULT '',
+			CREATED_AT TIMESTAMP NOT NULL,
+			PREV_HASH TEXT NOT NULL,
+			HASH TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS audit_log_org_idx ON audit_log (ORG_ID, ID);
+		-- Entries are chained per organization; those written before were
+		-- chained across the whole log
+		ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS ORG_CHAIN BOOLEAN NOT NULL DEFAULT false;
+		CREATE INDEX IF NOT EXISTS audit_log_platform_idx ON audit_log (ID) WHERE ORG_ID IS NULL;
+		CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (ENTITY_TYPE, ENTITY_ID);
+
+		CREATE OR REPLACE FUNCTION audit_log_immutable() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS audit_log_no_change ON audit_log;
+		CREATE TRIGGER audit_log_no_change BEFORE UPDATE OR DELETE ON audit_log
+			FOR EACH ROW EXECUTE FUNCTION audit_log_immutable();
+		DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+		CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+			FOR EACH STATEMENT EXECUTE FUNCTION audit_log_immutable();
+
+		ALTER TABLE stock ADD COLUMN IF NOT EXISTS UPDATED_BY UUID REFERENCES users(ID);
+
+		-- Every version of a product that was replaced, kept by a trigger so
+		-- no path that changes stock can skip it. The current version stays
+		-- in stock.
+		CREATE TABLE IF NOT EXISTS product_history (
+			PRODUCT_ID UUID NOT NULL REFERENCES stock(ID) ON DELETE CASCADE,
+			VERSION INTEGER NOT NULL,
+			DATA JSONB NOT NULL,
+			UPDATED_BY UUID,
+			UPDATED_AT TIMESTAMP,
+			PRIMARY KEY (PRODUCT_ID, VERSION)
+		);
+
+		CREATE OR REPLACE FUNCTION stock_keep_history() RETURNS trigger AS $$
+		BEGIN
+			INSERT INTO product_history (PRODUCT_ID, VERSION, DATA, UPDATED_BY, UPDATED_AT)
+			VALUES (OLD.ID, OLD.VERSION, to_jsonb(OLD), OLD.UPDATED_BY, OLD.UPDATED_AT)
+			ON CONFLICT DO NOTHING;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS stock_history ON stock;
+		CREATE TRIGGER stock_history AFTER UPDATE ON stock
+			FOR EACH ROW WHEN (OLD.VERSION IS DISTINCT FROM NEW.VERSION)
+			EXECUTE FUNCTION stock_keep_history();
+
+		-- Movements name their product, which names need not identify, and
+		-- the currency their unit price is in. Older movements take the
+		-- product the name resolved to when they were booked.
+		ALTER TABLE transactions ADD COLUMN IF NOT EXISTS PRODUCT_ID UUID;
+		ALTER TABLE transactions ADD COLUMN IF NOT EXISTS CURRENCY CHAR(3);
+		UPDATE transactions t SET PRODUCT_ID = s.ID, CURRENCY = s.CURRENCY
+		FROM stock s
+		WHERE t.PRODUCT_ID IS NULL AND s.ID = (
+			SELECT ID FROM stock WHERE ORG_ID = t.ORG_ID AND NAME = t.NAME
+			ORDER BY DELETED_AT NULLS FIRST LIMIT 1);
+		CREATE INDEX IF NOT EXISTS transactions_product_idx ON transactions (PRODUCT_ID)
 	`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create table: %w", err)
@@ -80,3 +494,9 @@ func SetupDb(cfg *DBConfig) (*sql.DB, error) {
 	log.Println("Table created successfully")
 	return dbConn, nil
 }
+
+// quoteConnValue quotes a connection string value, so passwords with
+// spaces or quotes survive
+func quoteConnValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
@@ -0,0 +1,407 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the whole configuration of the server. Load fills it from, in
+// increasing order of precedence: the defaults, an optional YAML file, the
+// environment and the command line flags.
+type Config struct {
+	Server   ServerConfig         `yaml:"server"`
+	DB       DBConfig             `yaml:"db"`
+	JWT      JWTConfig            `yaml:"jwt"`
+	Password PasswordConfig       `yaml:"password"`
+	Mail     MailConfig           `yaml:"mail"`
+	Login    LoginConfig          `yaml:"login"`
+	Admin    AdminConfig          `yaml:"admin"`
+	OIDC     []OIDCProviderConfig `yaml:"oidc"`
+}
+
+// Default returns the configuration used for every setting left unset
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:              ":8080",
+			RequestTimeout:    30 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      45 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    64 << 10,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		DB: DBConfig{
+			Host:            "localhost",
+			Port:            "5432",
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			LockTimeout:     5 * time.Second,
+		},
+		JWT: JWTConfig{
+			Issuer:    "auth-register-sistem",
+			Audience:  "auth-register-sistem",
+			AccessTTL: 24 * time.Hour,
+		},
+		Password: PasswordConfig{
+			MinLength:    8,
+			RequireUpper: true,
+			RequireLower: true,
+			RequireDigit: true,
+		},
+		Mail: MailConfig{
+			Driver:               "log",
+			From:                 "no-reply@localhost",
+			SMTPPort:             "587",
+			AppURL:               "http://localhost:8080",
+			PasswordResetTTL:     time.Hour,
+			EmailVerificationTTL: 48 * time.Hour,
+			DrainTimeout:         30 * time.Second,
+		},
+		Login: LoginConfig{
+			MaxFailures:     5,
+			Lockout:         15 * time.Minute,
+			IPMaxFailures:   20,
+			IPWindow:        15 * time.Minute,
+			BaseDelay:       250 * time.Millisecond,
+			MaxDelay:        5 * time.Second,
+			MFAIssuer:       "auth-register-sistem",
+			MFAChallengeTTL: 5 * time.Minute,
+		},
+	}
+}
+
+// setting binds an environment variable to a field of Config. Its flag is
+// the variable name in lower case with dashes, so DB_HOST is -db-host.
+type setting struct {
+	env   string
+	value interface{}
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"LISTEN_ADDR", &c.Server.Addr},
+		{"REQUEST_TIMEOUT", &c.Server.RequestTimeout},
+		{"SERVER_READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout},
+		{"SERVER_READ_TIMEOUT", &c.Server.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", &c.Server.IdleTimeout},
+		{"SERVER_MAX_HEADER_BYTES", &c.Server.MaxHeaderBytes},
+		{"SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout},
+
+		{"DB_HOST", &c.DB.Host},
+		{"DB_USERNAME", &c.DB.Username},
+		{"DB_PASSWORD", &c.DB.Password},
+		{"DB_DATABASE", &c.DB.Database},
+		{"DB_PORT", &c.DB.Port},
+		{"DB_SSLMODE", &c.DB.SSLMode},
+		{"DB_MAX_OPEN_CONNS", &c.DB.MaxOpenConns},
+		{"DB_MAX_IDLE_CONNS", &c.DB.MaxIdleConns},
+		{"DB_CONN_MAX_LIFETIME", &c.DB.ConnMaxLifetime},
+		{"DB_LOCK_TIMEOUT", &c.DB.LockTimeout},
+
+		{"JWT_KEYS_DIR", &c.JWT.KeysDir},
+		{"JWT_SIGNING_KID", &c.JWT.SigningKID},
+		{"JWT_ISSUER", &c.JWT.Issuer},
+		{"JWT_AUDIENCE", &c.JWT.Audience},
+		{"JWT_TTL", &c.JWT.AccessTTL},
+		{"JWT_SECRET", &c.JWT.LegacySecret},
+		{"JWT_ALLOW_EPHEMERAL_KEY", &c.JWT.AllowEphemeralKey},
+
+		{"PASSWORD_MIN_LENGTH", &c.Password.MinLength},
+		{"PASSWORD_REQUIRE_UPPER", &c.Password.RequireUpper},
+		{"PASSWORD_REQUIRE_LOWER", &c.Password.RequireLower},
+		{"PASSWORD_REQUIRE_DIGIT", &c.Password.RequireDigit},
+		{"PASSWORD_REQUIRE_SYMBOL", &c.Password.RequireSymbol},
+		{"PASSWORD_BREACHED_LIST", &c.Password.BreachedList},
+
+		{"MAIL_DRIVER", &c.Mail.Driver},
+		{"MAIL_FROM", &c.Mail.From},
+		{"SMTP_HOST", &c.Mail.SMTPHost},
+		{"SMTP_PORT", &c.Mail.SMTPPort},
+		{"SMTP_USERNAME", &c.Mail.SMTPUsername},
+		{"SMTP_PASSWORD", &c.Mail.SMTPPassword},
+		{"MAIL_LOG_FILE", &c.Mail.LogFile},
+		{"APP_URL", &c.Mail.AppURL},
+		{"REQUIRE_EMAIL_VERIFICATION", &c.Mail.RequireVerification},
+		{"PASSWORD_RESET_TTL", &c.Mail.PasswordResetTTL},
+		{"EMAIL_VERIFICATION_TTL", &c.Mail.EmailVerificationTTL},
+		{"MAIL_DRAIN_TIMEOUT", &c.Mail.DrainTimeout},
+
+		{"LOGIN_MAX_FAILURES", &c.Login.MaxFailures},
+		{"LOGIN_LOCKOUT", &c.Login.Lockout},
+		{"LOGIN_IP_MAX_FAILURES", &c.Login.IPMaxFailures},
+		{"LOGIN_IP_WINDOW", &c.Login.IPWindow},
+		{"LOGIN_DELAY_BASE", &c.Login.BaseDelay},
+		{"LOGIN_DELAY_MAX", &c.Login.MaxDelay},
+		{"TRUST_PROXY", &c.Login.TrustProxy},
+		{"MFA_ISSUER", &c.Login.MFAIssuer},
+		{"MFA_CHALLENGE_TTL", &c.Login.MFAChallengeTTL},
+
+		{"ADMIN_EMAIL", &c.Admin.Email},
+	}
+}
+
+func (s setting) flagName() string {
+	return strings.ToLower(strings.ReplaceAll(s.env, "_", "-"))
+}
+
+// set parses raw into the field of s
+func (s setting) set(raw string) error {
+	var err error
+	switch v := s.value.(type) {
+	case *string:
+		*v = raw
+	case *int:
+		*v, err = strconv.Atoi(raw)
+	case *bool:
+		*v, err = strconv.ParseBool(raw)
+	case *time.Duration:
+		*v, err = time.ParseDuration(raw)
+	default:
+		err = fmt.Errorf("unsupported type %T", v)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q: %w", raw, err)
+	}
+	return nil
+}
+
+// Load reads the configuration. args are the command line arguments
+// without the program name: -config names the YAML file, also taken from
+// CONFIG_FILE, and every setting has a flag named after its environment
+// variable. The result is validated; flag.ErrHelp is returned for -h.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file (env CONFIG_FILE)")
+	flagValues := map[string]string{}
+	for _, s := range settings {
+		name := s.flagName()
+		record := func(v string) error {
+			flagValues[name] = v
+			return nil
+		}
+		if _, ok := s.value.(*bool); ok {
+			fs.BoolFunc(name, "overrides "+s.env, record)
+		} else {
+			fs.Func(name, "overrides "+s.env, record)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := s.set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+	if providers := oidcFromEnv(); providers != nil {
+		cfg.OIDC = providers
+	}
+	for _, s := range settings {
+		if v, ok := flagValues[s.flagName()]; ok {
+			if err := s.set(v); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", s.flagName(), err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	cfg.fillOIDCDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile merges the YAML file at path into c. Unknown keys are rejected,
+// so a misspelled setting does not go unnoticed.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// oidcFromEnv reads the providers listed in OIDC_PROVIDERS, each
+// configured by OIDC_<NAME>_* variables. It returns nil when the variable
+// is unset, leaving the providers of the config file.
+func oidcFromEnv() []OIDCProviderConfig {
+	names := os.Getenv("OIDC_PROVIDERS")
+	if names == "" {
+		return nil
+	}
+	providers := []OIDCProviderConfig{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		providers = append(providers, OIDCProviderConfig{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		})
+	}
+	return providers
+}
+
+// fillOIDCDefaults points providers without a redirect URL at the
+// callback under APP_URL and gives them the standard scopes
+func (c *Config) fillOIDCDefaults() {
+	for i := range c.OIDC {
+		p := &c.OIDC[i]
+		if p.RedirectURL == "" {
+			p.RedirectURL = strings.TrimRight(c.Mail.AppURL, "/") + "/auth/oidc/" + p.Name + "/callback"
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		}
+	}
+}
+
+// sslModes are the modes lib/pq supports
+var sslModes = map[string]bool{"disable": true, "require": true, "verify-ca": true, "verify-full": true}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if _, port, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("server.addr: %w", err))
+	} else {
+		n, err := strconv.Atoi(port)
+		check(err == nil && n >= 0 && n <= 65535, "server.addr: invalid port %q", port)
+	}
+	check(c.Server.RequestTimeout >= 0, "server.request_timeout must not be negative")
+	check(c.Server.ReadHeaderTimeout > 0, "server.read_header_timeout must be positive")
+	check(c.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	check(c.Server.WriteTimeout > 0, "server.write_timeout must be positive")
+	check(c.Server.RequestTimeout == 0 || c.Server.WriteTimeout > c.Server.RequestTimeout,
+		"server.write_timeout must be longer than server.request_timeout")
+	check(c.Server.IdleTimeout > 0, "server.idle_timeout must be positive")
+	check(c.Server.MaxHeaderBytes > 0, "server.max_header_bytes must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+
+	check(c.DB.Host != "", "db.host is required")
+	check(c.DB.Username != "", "db.username is required")
+	check(c.DB.Database != "", "db.database is required")
+	port, err := strconv.Atoi(c.DB.Port)
+	check(err == nil && port > 0 && port <= 65535, "db.port: invalid port %q", c.DB.Port)
+	check(sslModes[c.DB.SSLMode], "db.sslmode: must be disable, require, verify-ca or verify-full, not %q", c.DB.SSLMode)
+	check(c.DB.MaxOpenConns >= 0, "db.max_open_conns must not be negative")
+	check(c.DB.MaxIdleConns >= 0, "db.max_idle_conns must not be negative")
+	check(c.DB.MaxOpenConns == 0 || c.DB.MaxIdleConns <= c.DB.MaxOpenConns,
+		"db.max_idle_conns must not exceed db.max_open_conns")
+	check(c.DB.ConnMaxLifetime >= 0, "db.conn_max_lifetime must not be negative")
+	check(c.DB.LockTimeout >= 0, "db.lock_timeout must not be negative")
+
+	check(c.JWT.KeysDir != "" || c.JWT.AllowEphemeralKey,
+		"jwt.keys_dir is required, or jwt.allow_ephemeral_key for a temporary development key")
+	check(c.JWT.Issuer != "", "jwt.issuer is required")
+	check(c.JWT.Audience != "", "jwt.audience is required")
+	check(c.JWT.AccessTTL > 0, "jwt.ttl must be positive")
+
+	check(c.Password.MinLength > 0, "password.min_length must be positive")
+
+	check(c.Mail.Driver == "smtp" || c.Mail.Driver == "log", "mail.driver: must be smtp or log, not %q", c.Mail.Driver)
+	check(c.Mail.Driver != "smtp" || c.Mail.SMTPHost != "", "mail.smtp_host is required by the smtp driver")
+	if u, err := url.Parse(c.Mail.AppURL); err != nil || u.Scheme == "" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		errs = append(errs, fmt.Errorf("mail.app_url: %q is not an absolute URL without query", c.Mail.AppURL))
+	}
+	check(c.Mail.PasswordResetTTL > 0, "mail.password_reset_ttl must be positive")
+	check(c.Mail.EmailVerificationTTL > 0, "mail.email_verification_ttl must be positive")
+	check(c.Mail.DrainTimeout > 0, "mail.drain_timeout must be positive")
+
+	check(c.Login.MaxFailures > 0, "login.max_failures must be positive")
+	check(c.Login.Lockout > 0, "login.lockout must be positive")
+	check(c.Login.IPMaxFailures > 0, "login.ip_max_failures must be positive")
+	check(c.Login.IPWindow > 0, "login.ip_window must be positive")
+	check(c.Login.BaseDelay >= 0, "login.delay_base must not be negative")
+	check(c.Login.MaxDelay >= c.Login.BaseDelay, "login.delay_max must not be shorter than login.delay_base")
+	check(c.Login.MFAChallengeTTL > 0, "login.mfa_challenge_ttl must be positive")
+
+	check(c.Admin.Email == "" || strings.Contains(c.Admin.Email, "@"), "admin.email: %q is not an email address", c.Admin.Email)
+
+	for _, p := range c.OIDC {
+		check(p.Name != "", "oidc: every provider needs a name")
+		check(p.Issuer != "" && p.ClientID != "", "oidc.%s: issuer and client_id are required", p.Name)
+	}
+	return errors.Join(errs...)
+}
+
+// redacted replaces the secrets printed by Dump
+const redacted = "[redacted]"
+
+// Dump renders the effective configuration as YAML with its secrets
+// redacted, for the startup log
+func (c *Config) Dump() string {
+	safe := *c
+	safe.DB.Password = redact(safe.DB.Password)
+	safe.JWT.LegacySecret = redact(safe.JWT.LegacySecret)
+	safe.Mail.SMTPPassword = redact(safe.Mail.SMTPPassword)
+	safe.OIDC = make([]OIDCProviderConfig, len(c.OIDC))
+	for i, p := range c.OIDC {
+		p.ClientSecret = redact(p.ClientSecret)
+		safe.OIDC[i] = p
+	}
+
+	out, err := yaml.Marshal(safe)
+	if err != nil {
+		return "failed to render configuration: " + err.Error()
+	}
+	return string(out)
+}
+
+// redact hides a secret, keeping whether it is set visible
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
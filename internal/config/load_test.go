@@ -0,0 +1,194 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isolateEnv blanks every variable Load reads, so the environment of the
+// test run cannot leak into the result. Load ignores empty variables.
+func isolateEnv(t *testing.T) {
+	t.Helper()
+	for _, s := range Default().settings() {
+		t.Setenv(s.env, "")
+	}
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("OIDC_PROVIDERS", "")
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	isolateEnv(t)
+	path := writeConfigFile(t, `
+server:
+  addr: ":9000"
+db:
+  host: yaml-host
+  username: yaml-user
+  database: yaml-db
+  port: "1111"
+jwt:
+  keys_dir: keys
+login:
+  trust_proxy: true
+`)
+	t.Setenv("DB_DATABASE", "env-db")
+	t.Setenv("DB_PORT", "2222")
+
+	cfg, err := Load([]string{"-config", path, "-db-database", "flag-db", "-trust-proxy=false"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"default", cfg.DB.SSLMode, "disable"},
+		{"default duration", cfg.Server.ReadTimeout, 15 * time.Second},
+		{"yaml over default", cfg.Server.Addr, ":9000"},
+		{"yaml", cfg.DB.Host, "yaml-host"},
+		{"env over yaml", cfg.DB.Port, "2222"},
+		{"flag over env", cfg.DB.Database, "flag-db"},
+		{"bool flag over yaml", cfg.Login.TrustProxy, false},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	isolateEnv(t)
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "db:\n  username: u\n  database: d\njwt:\n  keys_dir: keys\n"))
+
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.DB.Username != "u" || cfg.DB.Database != "d" {
+		t.Errorf("got username %q and database %q, want u and d", cfg.DB.Username, cfg.DB.Database)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	isolateEnv(t)
+	path := writeConfigFile(t, "db:\n  hots: localhost\n")
+
+	_, err := Load([]string{"-config", path})
+	if err == nil || !strings.Contains(err.Error(), "hots") {
+		t.Fatalf("got %v, want an error naming the unknown key", err)
+	}
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+	isolateEnv(t)
+	t.Setenv("DB_MAX_OPEN_CONNS", "many")
+
+	_, err := Load([]string{"-jwt-ttl", "soon"})
+	if err == nil {
+		t.Fatal("got nil, want an error")
+	}
+	for _, want := range []string{"DB_MAX_OPEN_CONNS", "-jwt-ttl"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestValidateReportsEveryError(t *testing.T) {
+	cfg := Default()
+	cfg.DB.SSLMode = "sometimes"
+	cfg.Mail.Driver = "smtp"
+	cfg.Login.MaxDelay = time.Millisecond
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("got nil, want an error")
+	}
+	for _, want := range []string{
+		"db.username is required",
+		"db.database is required",
+		"db.sslmode",
+		"jwt.keys_dir is required",
+		"mail.smtp_host is required",
+		"login.delay_max",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestValidateAcceptsDefaults(t *testing.T) {
+	cfg := Default()
+	cfg.DB.Username = "u"
+	cfg.DB.Database = "d"
+	cfg.JWT.KeysDir = "keys"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestValidateEphemeralKeyNeedsOptIn(t *testing.T) {
+	cfg := Default()
+	cfg.DB.Username = "u"
+	cfg.DB.Database = "d"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "jwt.keys_dir") {
+		t.Fatalf("got %v, want an error about jwt.keys_dir", err)
+	}
+
+	cfg.JWT.AllowEphemeralKey = true
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("with allow_ephemeral_key: got %v, want nil", err)
+	}
+}
+
+func TestDumpRedactsSecrets(t *testing.T) {
+	isolateEnv(t)
+	path := writeConfigFile(t, `
+db:
+  username: u
+  database: d
+  password: yaml-db-password
+jwt:
+  keys_dir: keys
+oidc:
+  - name: google
+    issuer: https://accounts.google.com
+    client_id: client
+    client_secret: yaml-client-secret
+`)
+	t.Setenv("JWT_SECRET", "env-jwt-secret")
+	t.Setenv("SMTP_PASSWORD", "env-smtp-password")
+
+	cfg, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	dump := cfg.Dump()
+	for _, secret := range []string{"yaml-db-password", "yaml-client-secret", "env-jwt-secret", "env-smtp-password"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("Dump() shows %s", secret)
+		}
+	}
+	if got := strings.Count(dump, redacted); got != 4 {
+		t.Errorf("Dump() redacted %d secrets, want 4", got)
+	}
+	if cfg.DB.Password != "yaml-db-password" || cfg.OIDC[0].ClientSecret != "yaml-client-secret" {
+		t.Error("Dump() changed the secrets of the config")
+	}
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/user"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tokenLink is the link to path under APP_URL carrying token, answered by
+// the GET routes of VerifyEmail and ResetPasswordForm
+func (h *UserHandler) tokenLink(path, token string) string {
+	return strings.TrimRight(h.AppURL, "/") + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+// sendVerification emails a verification link to a new or changed address.
+// Failures are only logged: the user can ask for another link.
+func (h *UserHandler) sendVerification(ctx context.Context, id uuid.UUID, name, email string) {
+	token, err := h.Tokens.CreateToken(ctx, id, user.PurposeEmailVerification, h.EmailVerificationTTL)
+	if err != nil {
+		log.Println("Failed to create verification token:", err)
+		return
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\nConfirm your email address by opening the link below:\n\n%s\n\nThe link expires in %s.\n",
+		name, h.tokenLink("/email/verify", token), h.EmailVerificationTTL)
+	if err := h.Mailer.Send(email, "Confirm your email address", body); err != nil {
+		log.Println("Failed to send verification email:", err)
+	}
+}
+
+// ForgotPassword emails a password reset link. It answers the same way
+// whether or not the email belongs to an account.
+func (h *UserHandler) ForgotPassword(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.Repo.FindByEmail(request.Context(), strings.ToLower(strings.TrimSpace(req.Email)))
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Failed to find user", http.StatusInternalServerError)
+		return
+	}
+
+	if u != nil && u.DisabledAt == nil {
+		token, err := h.Tokens.CreateToken(request.Context(), u.ID, user.PurposePasswordReset, h.PasswordResetTTL)
+		if err != nil {
+			problem.Error(writer, "Failed to create token", http.StatusInternalServerError)
+			return
+		}
+
+		body := fmt.Sprintf("Hello %s,\n\nReset your password by opening the link below:\n\n%s\n\nThe link expires in %s. If you did not ask for it, ignore this email.\n",
+			u.Name, h.tokenLink("/password/reset", token), h.PasswordResetTTL)
+		if err := h.Mailer.Send(u.Email, "Reset your password", body); err != nil {
+			log.Println("Failed to send password reset email:", err)
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(writer).Encode(map[string]string{
+		"message": "If the email belongs to an account, a reset link was sent",
+	})
+}
+
+// resetPasswordForm is the page the reset link opens. It posts the token
+// and the new password back to POST /password/reset as a form.
+var resetPasswordForm = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Reset your password</title></head>
+<body>
+<form method="post" action="/password/reset">
+<input type="hidden" name="token" value="{{.}}">
+<label>New password <input type="password" name="password" autocomplete="new-password" required></label>
+<button type="submit">Reset password</button>
+</form>
+</body>
+</html>
+`))
+
+// ResetPasswordForm serves the form of the link in password reset emails
+func (h *UserHandler) ResetPasswordForm(writer http.ResponseWriter, request *http.Request) {
+	token := request.URL.Query().Get("token")
+	if token == "" {
+		problem.Error(writer, "Token is required", http.StatusBadRequest)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Referrer-Policy", "no-referrer")
+	writer.WriteHeader(http.StatusOK)
+	resetPasswordForm.Execute(writer, token)
+}
+
+// ResetPassword sets a new password using a reset token, given as JSON or
+// by the form of ResetPasswordForm
+func (h *UserHandler) ResetPassword(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		req.Token = request.PostFormValue("token")
+		req.Password = request.PostFormValue("password")
+	} else if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Password = strings.TrimSpace(req.Password)
+	if problems := h.Policy.Validate(req.Password); len(problems) > 0 {
+		writeFieldErrors(writer, http.StatusBadRequest, "Validation failed", map[string]string{
+			"password": strings.Join(problems, "; "),
+		})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		problem.Error(writer, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = h.Tokens.ResetPassword(request.Context(), req.Token, string(hashedPassword), middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Invalid or expired token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]string{
+		"message": "Password reset successfully",
+	})
+}
+
+// VerifyEmail confirms an email address using a verification token, sent
+// as JSON or, from the link in the email, as the token query parameter
+func (h *UserHandler) VerifyEmail(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if request.Method == http.MethodGet {
+		req.Token = request.URL.Query().Get("token")
+	} else if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	_, err := h.Tokens.VerifyEmail(request.Context(), req.Token, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Invalid or expired token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]string{
+		"message": "Email verified successfully",
+	})
+}
+
+// ResendVerification sends a new verification link to the caller
+func (h *UserHandler) ResendVerification(writer http.ResponseWriter, request *http.Request) {
+	userID, _ := request.Context().Value(middleware.UserIDKey).(string)
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		problem.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	u, err := h.Repo.FindByID(request.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to find user", http.StatusInternalServerError)
+		return
+	}
+	if u.EmailVerifiedAt != nil {
+		problem.Error(writer, "Email is already verified", http.StatusConflict)
+		return
+	}
+
+	h.sendVerification(request.Context(), u.ID, u.Name, u.Email)
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(writer).Encode(map[string]string{
+		"message": "Verification email sent",
+	})
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/apikey"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type APIKeyHandler struct {
+	Repo repository.APIKeyRepository
+}
+
+func NewAPIKeyHandler(repo repository.APIKeyRepository) *APIKeyHandler {
+	return &APIKeyHandler{Repo: repo}
+}
+
+// CreateAPIKey issues a key for a service, valid in the caller's current
+// organization. The key is only returned here.
+func (h *APIKeyHandler) CreateAPIKey(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		problem.Error(writer, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		problem.Error(writer, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !apikey.ValidScope(scope) {
+			problem.Error(writer, "Invalid scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		problem.Error(writer, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	key, created, err := h.Repo.Create(request.Context(), apikey.APIKey{
+		OrgID:     middleware.OrgID(request.Context()),
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		CreatedBy: middleware.ActorID(request.Context()),
+		ExpiresAt: req.ExpiresAt,
+	}, middleware.Actor(request.Context()))
+	if err != nil {
+		problem.Error(writer, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"key":     key,
+		"api_key": created,
+		"message": "Store this key safely, it will not be shown again",
+	})
+}
+
+// ListAPIKeys lists the keys of the organization, without their secrets
+func (h *APIKeyHandler) ListAPIKeys(writer http.ResponseWriter, request *http.Request) {
+	keys, err := h.Repo.List(request.Context(), middleware.OrgID(request.Context()))
+	if err != nil {
+		problem.Error(writer, "Failed to list API keys", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(keys)
+}
+
+// RevokeAPIKey disables a key immediately
+func (h *APIKeyHandler) RevokeAPIKey(writer http.ResponseWriter, request *http.Request) {
+	id, err := uuid.Parse(request.PathValue("id"))
+	if err != nil {
+		problem.Error(writer, "Invalid id format", http.StatusBadRequest)
+		return
+	}
+
+	err = h.Repo.Revoke(request.Context(), middleware.OrgID(request.Context()), id, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "API key not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]string{
+		"message": "API key revoked successfully",
+	})
+}
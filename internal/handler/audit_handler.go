@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/user"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// AuditHandler serves the audit log. Platform admins see every entry and
+// may filter by organization; other users only see the organization they
+// are working in.
+type AuditHandler struct {
+	Repo repository.AuditRepository
+}
+
+func NewAuditHandler(repo repository.AuditRepository) *AuditHandler {
+	return &AuditHandler{Repo: repo}
+}
+
+// ListAudit returns the latest entries, filtered by ?entity_type=,
+// ?entity_id=, ?actor_id=, ?action=, ?from= and ?to=. Older pages are
+// fetched with ?before_id= set to the last id received.
+func (h *AuditHandler) ListAudit(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	filter := audit.Filter{
+		EntityType: query.Get("entity_type"),
+		EntityID:   query.Get("entity_id"),
+		Action:     query.Get("action"),
+		Limit:      100,
+	}
+
+	if role, _ := request.Context().Value(middleware.RoleKey).(string); role == user.RoleAdmin {
+		if v := query.Get("org_id"); v != "" {
+			orgID, err := uuid.Parse(v)
+			if err != nil {
+				problem.Error(writer, "Invalid org_id format", http.StatusBadRequest)
+				return
+			}
+			filter.OrgID = uuid.NullUUID{UUID: orgID, Valid: true}
+		}
+	} else {
+		orgID := middleware.OrgID(request.Context())
+		if orgID == uuid.Nil {
+			problem.ErrorCode(writer, "No organization selected, create or switch to one first", http.StatusForbidden, problem.CodeOrgRequired)
+			return
+		}
+		filter.OrgID = uuid.NullUUID{UUID: orgID, Valid: true}
+	}
+
+	if v := query.Get("actor_id"); v != "" {
+		actorID, err := uuid.Parse(v)
+		if err != nil {
+			problem.Error(writer, "Invalid actor_id format", http.StatusBadRequest)
+			return
+		}
+		filter.ActorID = uuid.NullUUID{UUID: actorID, Valid: true}
+	}
+
+	var ok bool
+	if filter.From, ok = parseTimeParam(request, "from"); !ok {
+		problem.Error(writer, "Invalid from parameter", http.StatusBadRequest)
+		return
+	}
+	if filter.To, ok = parseTimeParam(request, "to"); !ok {
+		problem.Error(writer, "Invalid to parameter", http.StatusBadRequest)
+		return
+	}
+
+	if v := query.Get("before_id"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			problem.Error(writer, "Invalid before_id parameter", http.StatusBadRequest)
+			return
+		}
+		filter.BeforeID = n
+	}
+
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			problem.Error(writer, "Limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+
+	entries, err := h.Repo.List(request.Context(), filter)
+	if err != nil {
+		writeError(writer, err, "Failed to list audit log")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(entries)
+}
+
+// VerifyAudit recomputes the hash chain of the whole log
+func (h *AuditHandler) VerifyAudit(writer http.ResponseWriter, request *http.Request) {
+	result, err := h.Repo.Verify(request.Context())
+	if err != nil {
+		writeError(writer, err, "Failed to verify audit log")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(result)
+}
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/bom"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+type BOMHandler struct {
+	Repo repository.BOMRepository
+}
+
+func NewBOMHandler(repo repository.BOMRepository) *BOMHandler {
+	return &BOMHandler{Repo: repo}
+}
+
+// parseKitID reads the kit_id query parameter
+func parseKitID(writer http.ResponseWriter, request *http.Request) (uuid.UUID, bool) {
+	idStr := request.URL.Query().Get("kit_id")
+	if idStr == "" {
+		problem.Error(writer, "Missing kit_id parameter", http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		problem.Error(writer, "Invalid kit_id format", http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// SetBOM replaces the components of a kit
+func (h *BOMHandler) SetBOM(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		KitID      uuid.UUID `json:"kit_id"`
+		Components []struct {
+			ComponentID uuid.UUID       `json:"component_id"`
+			Quantity    decimal.Decimal `json:"quantity"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.KitID == uuid.Nil {
+		problem.Error(writer, "kit_id is required", http.StatusBadRequest)
+		return
+	}
+
+	seen := make(map[uuid.UUID]bool)
+	components := make([]bom.Component, 0, len(req.Components))
+	for _, c := range req.Components {
+		if c.ComponentID == uuid.Nil || c.ComponentID == req.KitID {
+			problem.Error(writer, "Invalid component_id", http.StatusBadRequest)
+			return
+		}
+		if seen[c.ComponentID] {
+			problem.Error(writer, "Duplicate component_id", http.StatusBadRequest)
+			return
+		}
+		if !c.Quantity.IsPositive() {
+			problem.Error(writer, "Quantity must be greater than zero", http.StatusBadRequest)
+			return
+		}
+		seen[c.ComponentID] = true
+		components = append(components, bom.Component{KitID: req.KitID, ComponentID: c.ComponentID, Quantity: c.Quantity})
+	}
+
+	err := h.Repo.SetBOM(request.Context(), middleware.OrgID(request.Context()), req.KitID, components, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Kit or component not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(writer, err, "Failed to save bill of materials")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"kit_id":  req.KitID,
+		"message": "Bill of materials saved successfully",
+	})
+}
+
+// GetBOM lists the components of a kit
+func (h *BOMHandler) GetBOM(writer http.ResponseWriter, request *http.Request) {
+	kitID, ok := parseKitID(writer, request)
+	if !ok {
+		return
+	}
+
+	components, err := h.Repo.GetBOM(request.Context(), middleware.OrgID(request.Context()), kitID)
+	if err != nil {
+		writeError(writer, err, "Failed to get bill of materials")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(components)
+}
+
+// CreateOperation assembles or disassembles kits
+func (h *BOMHandler) CreateOperation(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		KitID    uuid.UUID       `json:"kit_id"`
+		Type     string          `json:"type"`
+		Quantity decimal.Decimal `json:"quantity"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Type != string(bom.TypeAssembly) && req.Type != string(bom.TypeDisassembly) {
+		problem.Error(writer, "Invalid operation type", http.StatusBadRequest)
+		return
+	}
+
+	if !req.Quantity.IsPositive() {
+		problem.Error(writer, "Quantity must be greater than zero", http.StatusBadRequest)
+		return
+	}
+
+	id, err := h.Repo.CreateOperation(request.Context(), middleware.OrgID(request.Context()), bom.Operation{
+		KitID:     req.KitID,
+		Type:      bom.OperationType(req.Type),
+		Quantity:  req.Quantity,
+		CreatedBy: middleware.ActorID(request.Context()),
+	}, middleware.Actor(request.Context()))
+	if err != nil {
+		writeError(writer, err, "Failed to create operation")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"id":      id,
+		"message": "Operation created successfully",
+	})
+}
+
+// GetBuildableQuantity reports how many kits can be built from current stock
+func (h *BOMHandler) GetBuildableQuantity(writer http.ResponseWriter, request *http.Request) {
+	kitID, ok := parseKitID(writer, request)
+	if !ok {
+		return
+	}
+
+	buildable, err := h.Repo.GetBuildableQuantity(request.Context(), middleware.OrgID(request.Context()), kitID)
+	if err != nil {
+		writeError(writer, err, "Failed to compute buildable quantity")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"kit_id":    kitID,
+		"buildable": buildable,
+	})
+}
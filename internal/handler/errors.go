@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"errors"
+	"log"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+)
+
+// writeFieldErrors responds with a message per invalid field. Conflicts
+// are reported as already_exists, anything else as validation_failed.
+func writeFieldErrors(writer http.ResponseWriter, status int, message string, fields map[string]string) {
+	code := problem.CodeValidation
+	if status == http.StatusConflict {
+		code = problem.CodeAlreadyExists
+	}
+	problem.FieldErrors(writer, message, status, code, fields)
+}
+
+// writeUniqueViolation reports a duplicate username or email as 409, and
+// returns false for any other error.
+func writeUniqueViolation(writer http.ResponseWriter, err error) bool {
+	var dup *repository.UniqueViolationError
+	if !errors.As(err, &dup) {
+		return false
+	}
+	writeFieldErrors(writer, http.StatusConflict, "Account already exists", map[string]string{
+		dup.Field: "is already taken",
+	})
+	return true
+}
+
+// writeError reports an error returned by a repository. Errors matching
+// the repository sentinels get their status and are described to the
+// caller; queries that timed out are reported as a 503 the caller may
+// retry; anything else is logged and reported as a 500 with message, so
+// database details never reach the response.
+func writeError(writer http.ResponseWriter, err error, message string) {
+	var dup *repository.UniqueViolationError
+	var short *repository.InsufficientStockError
+	switch {
+	case repository.IsTimeout(err):
+		log.Println(message+":", err)
+		problem.ErrorCode(writer, "The request took too long, try again", http.StatusServiceUnavailable, problem.CodeTimeout)
+	case errors.As(err, &dup):
+		writeFieldErrors(writer, http.StatusConflict, capitalize(err.Error()), map[string]string{
+			dup.Field: "is already taken",
+		})
+	case errors.As(err, &short):
+		problem.Extended(writer, capitalize(short.Error()), http.StatusUnprocessableEntity, problem.CodeInsufficientStock, map[string]interface{}{
+			"product":   short.Product,
+			"available": short.Available,
+			"requested": short.Requested,
+		})
+	case errors.Is(err, repository.ErrNotFound):
+		problem.ErrorCode(writer, capitalize(err.Error()), http.StatusNotFound, problem.CodeNotFound)
+	case errors.Is(err, repository.ErrVersionMismatch):
+		problem.ErrorCode(writer, "Product was modified, fetch it again and retry", http.StatusPreconditionFailed, problem.CodeVersionMismatch)
+	case errors.Is(err, repository.ErrInsufficientStock):
+		problem.ErrorCode(writer, capitalize(err.Error()), http.StatusUnprocessableEntity, problem.CodeInsufficientStock)
+	case errors.Is(err, repository.ErrInvalid):
+		problem.ErrorCode(writer, capitalize(err.Error()), http.StatusUnprocessableEntity, problem.CodeUnprocessable)
+	case errors.Is(err, repository.ErrConflict):
+		problem.ErrorCode(writer, capitalize(err.Error()), http.StatusConflict, problem.CodeConflict)
+	default:
+		log.Println(message+":", err)
+		problem.Error(writer, message, http.StatusInternalServerError)
+	}
+}
+
+// capitalize upper-cases the first letter of an error message for use as
+// a response detail
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
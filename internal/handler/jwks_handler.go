@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/jwtauth"
+	"encoding/json"
+	"net/http"
+)
+
+type JWKSHandler struct {
+	Keys *jwtauth.Manager
+}
+
+func NewJWKSHandler(keys *jwtauth.Manager) *JWKSHandler {
+	return &JWKSHandler{Keys: keys}
+}
+
+// GetJWKS publishes the public keys other services verify our tokens with
+func (h *JWKSHandler) GetJWKS(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "public, max-age=300")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(h.Keys.JWKS())
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// mergePatch applies an RFC 7396 JSON merge patch to target. Both values
+// are the generic form produced by decoding JSON into an interface{}.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+			continue
+		}
+		targetObj[key] = mergePatch(targetObj[key], value)
+	}
+	return targetObj
+}
+
+// applyMergePatch merges patch into the JSON encoding of v and decodes the
+// result back into v. Fields of the result that v does not have are
+// rejected, so a patch cannot touch anything outside v. v is zeroed before
+// decoding, so fields the patch set to null end up cleared; a null for a
+// field that cannot hold one, such as a string or a number, is an error
+// rather than its zero value.
+func applyMergePatch(v interface{}, patch []byte) error {
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var target, patchValue interface{}
+	if err := decodeNumbers(doc, &target); err != nil {
+		return err
+	}
+	if err := decodeNumbers(patch, &patchValue); err != nil {
+		return err
+	}
+
+	merged, err := json.Marshal(mergePatch(target, patchValue))
+	if err != nil {
+		return err
+	}
+
+	rv := reflect.ValueOf(v).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+
+	dec := json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	return checkNulls(v, patchValue)
+}
+
+// checkNulls makes sure every field patch set to null is null in v
+func checkNulls(v, patch interface{}) error {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(doc, &result); err != nil {
+		return err
+	}
+
+	for key, value := range patchObj {
+		if value != nil {
+			continue
+		}
+		cleared, known := result[key]
+		if !known {
+			return fmt.Errorf("json: unknown field %q", key)
+		}
+		if cleared != nil {
+			return fmt.Errorf("%s cannot be null", key)
+		}
+	}
+	return nil
+}
+
+// decodeNumbers decodes data keeping numbers as json.Number, so decimal
+// quantities and prices survive the round trip exactly.
+func decodeNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// TestMergePatchRFC7396 runs the examples of RFC 7396 appendix A
+func TestMergePatchRFC7396(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		var target, patch interface{}
+		if err := decodeNumbers([]byte(tt.target), &target); err != nil {
+			t.Fatal(err)
+		}
+		if err := decodeNumbers([]byte(tt.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := json.Marshal(mergePatch(target, patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s patched with %s = %s, want %s", tt.target, tt.patch, got, tt.want)
+		}
+	}
+}
+
+type patchFixture struct {
+	Name  string              `json:"name"`
+	Price decimal.NullDecimal `json:"price"`
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		want    patchFixture
+		wantErr bool
+	}{
+		{
+			name:  "empty patch",
+			patch: `{}`,
+			want:  patchFixture{Name: "Pen", Price: decimal.NewNullDecimal(decimal.RequireFromString("1.50"))},
+		},
+		{
+			name:  "exact decimal",
+			patch: `{"price": 12.345678901234567891}`,
+			want:  patchFixture{Name: "Pen", Price: decimal.NewNullDecimal(decimal.RequireFromString("12.345678901234567891"))},
+		},
+		{
+			name:  "null clears",
+			patch: `{"name": "Pencil", "price": null}`,
+			want:  patchFixture{Name: "Pencil"},
+		},
+		{name: "unknown field", patch: `{"colour": "red"}`, wantErr: true},
+		{name: "unknown field set to null", patch: `{"colour": null}`, wantErr: true},
+		{name: "null for a non-nullable field", patch: `{"name": null}`, wantErr: true},
+		{name: "wrong type", patch: `{"name": 1}`, wantErr: true},
+		{name: "invalid JSON", patch: `{"name":`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := patchFixture{Name: "Pen", Price: decimal.NewNullDecimal(decimal.RequireFromString("1.50"))}
+			err := applyMergePatch(&v, []byte(tt.patch))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Name != tt.want.Name || v.Price.Valid != tt.want.Price.Valid || !v.Price.Decimal.Equal(tt.want.Price.Decimal) {
+				t.Errorf("got %+v, want %+v", v, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/auth"
+	"auth-register-sistem/internal/model/user"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"auth-register-sistem/internal/totp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// callerID returns the id of the authenticated user
+func callerID(writer http.ResponseWriter, request *http.Request) (uuid.UUID, bool) {
+	userID, _ := request.Context().Value(middleware.UserIDKey).(string)
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		problem.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// checkMFACode accepts either a current TOTP code, which cannot be reused,
+// or an unused recovery code
+func (h *UserHandler) checkMFACode(ctx context.Context, userID uuid.UUID, mfa *user.MFA, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		counter, ok := totp.Validate(mfa.Secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		err := h.MFA.UseCounter(ctx, userID, counter)
+		if errors.Is(err, repository.ErrConflict) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	err := h.MFA.UseRecoveryCode(ctx, userID, code)
+	if errors.Is(err, repository.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// decodeMFACode reads a {"code": "..."} body
+func decodeMFACode(writer http.ResponseWriter, request *http.Request) (string, bool) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return "", false
+	}
+	return req.Code, true
+}
+
+// requireMFACode checks the code in the body against the caller's enabled
+// MFA and writes the error response when it fails
+func (h *UserHandler) requireMFACode(writer http.ResponseWriter, request *http.Request, id uuid.UUID) bool {
+	code, ok := decodeMFACode(writer, request)
+	if !ok {
+		return false
+	}
+
+	mfa, err := h.MFA.GetMFA(request.Context(), id)
+	if err != nil {
+		problem.Error(writer, "Failed to get MFA", http.StatusInternalServerError)
+		return false
+	}
+	if mfa.EnabledAt == nil {
+		problem.Error(writer, "MFA is not enabled", http.StatusConflict)
+		return false
+	}
+
+	valid, err := h.checkMFACode(request.Context(), id, mfa, code)
+	if err != nil {
+		problem.Error(writer, "Failed to check MFA code", http.StatusInternalServerError)
+		return false
+	}
+	if !valid {
+		problem.Error(writer, "Invalid MFA code", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func writeRecoveryCodes(writer http.ResponseWriter, codes []string) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"recovery_codes": codes,
+		"message":        "Store these recovery codes safely, they will not be shown again",
+	})
+}
+
+// EnrollMFA generates a new TOTP secret for the caller. It only takes
+// effect once confirmed with VerifyMFA.
+func (h *UserHandler) EnrollMFA(writer http.ResponseWriter, request *http.Request) {
+	id, ok := callerID(writer, request)
+	if !ok {
+		return
+	}
+
+	u, err := h.Repo.FindByID(request.Context(), id)
+	if err != nil {
+		problem.Error(writer, "Failed to find user", http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		problem.Error(writer, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	err = h.MFA.SetPendingSecret(request.Context(), id, secret)
+	if errors.Is(err, repository.ErrConflict) {
+		problem.Error(writer, "MFA is already enabled", http.StatusConflict)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to enroll MFA", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(h.Throttle.MFAIssuer, u.Username, secret),
+		"message":     "Add the secret to an authenticator app and confirm it with a code",
+	})
+}
+
+// VerifyMFA confirms enrollment with a code from the authenticator app,
+// enables MFA and returns the recovery codes
+func (h *UserHandler) VerifyMFA(writer http.ResponseWriter, request *http.Request) {
+	id, ok := callerID(writer, request)
+	if !ok {
+		return
+	}
+
+	code, ok := decodeMFACode(writer, request)
+	if !ok {
+		return
+	}
+
+	mfa, err := h.MFA.GetMFA(request.Context(), id)
+	if err != nil {
+		problem.Error(writer, "Failed to get MFA", http.StatusInternalServerError)
+		return
+	}
+	if mfa.EnabledAt != nil {
+		problem.Error(writer, "MFA is already enabled", http.StatusConflict)
+		return
+	}
+	if mfa.Secret == "" {
+		problem.Error(writer, "Start MFA enrollment first", http.StatusConflict)
+		return
+	}
+
+	counter, valid := totp.Validate(mfa.Secret, strings.TrimSpace(code), time.Now())
+	if !valid {
+		problem.Error(writer, "Invalid MFA code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := h.MFA.Enable(request.Context(), id, counter, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrConflict) {
+		problem.Error(writer, "MFA is already enabled", http.StatusConflict)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to enable MFA", http.StatusInternalServerError)
+		return
+	}
+
+	writeRecoveryCodes(writer, codes)
+}
+
+// DisableMFA turns MFA off for the caller after checking a code
+func (h *UserHandler) DisableMFA(writer http.ResponseWriter, request *http.Request) {
+	id, ok := callerID(writer, request)
+	if !ok {
+		return
+	}
+
+	if !h.requireMFACode(writer, request, id) {
+		return
+	}
+
+	if err := h.MFA.Disable(request.Context(), id, middleware.Actor(request.Context())); err != nil {
+		problem.Error(writer, "Failed to disable MFA", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeUser(request.Context(), writer, id)
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes after
+// checking a code
+func (h *UserHandler) RegenerateRecoveryCodes(writer http.ResponseWriter, request *http.Request) {
+	id, ok := callerID(writer, request)
+	if !ok {
+		return
+	}
+
+	if !h.requireMFACode(writer, request, id) {
+		return
+	}
+
+	codes, err := h.MFA.ReplaceRecoveryCodes(request.Context(), id)
+	if err != nil {
+		problem.Error(writer, "Failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	writeRecoveryCodes(writer, codes)
+}
+
+// ResetMFA lets an admin turn off MFA for a user who lost both the device
+// and the recovery codes
+func (h *UserHandler) ResetMFA(writer http.ResponseWriter, request *http.Request) {
+	id, ok := parseUserID(writer, request)
+	if !ok {
+		return
+	}
+
+	err := h.MFA.Disable(request.Context(), id, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to disable MFA", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeUser(request.Context(), writer, id)
+}
+
+// LoginMFA is the second login step: it exchanges the challenge token from
+// Login plus a TOTP or recovery code for an access token
+func (h *UserHandler) LoginMFA(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := h.JWT.Parse(req.MFAToken)
+	if err != nil {
+		problem.Error(writer, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	userID, _ := claims["user_id"].(string)
+	id, err := uuid.Parse(userID)
+	if claims["typ"] != middleware.TokenTypeMFAChallenge || err != nil {
+		problem.Error(writer, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	u, err := h.Repo.FindByID(request.Context(), id)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Failed to find user", http.StatusInternalServerError)
+		return
+	}
+	if u == nil || u.DisabledAt != nil {
+		problem.Error(writer, "Account not found or disabled", http.StatusUnauthorized)
+		return
+	}
+	if u.Locked {
+		h.recordAttempt(request, u.Username, u, auth.ReasonLocked)
+		problem.Error(writer, "Invalid MFA code", http.StatusUnauthorized)
+		return
+	}
+
+	select {
+	case <-time.After(h.loginDelay(u.FailedLogins)):
+	case <-request.Context().Done():
+		return
+	}
+
+	mfa, err := h.MFA.GetMFA(request.Context(), id)
+	if err != nil {
+		problem.Error(writer, "Failed to get MFA", http.StatusInternalServerError)
+		return
+	}
+	if mfa.EnabledAt == nil {
+		problem.Error(writer, "MFA is not enabled", http.StatusConflict)
+		return
+	}
+
+	valid, err := h.checkMFACode(request.Context(), id, mfa, req.Code)
+	if err != nil {
+		problem.Error(writer, "Failed to check MFA code", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		if err := h.Repo.RegisterFailedLogin(context.WithoutCancel(request.Context()), id, h.Throttle.MaxFailures, h.Throttle.Lockout); err != nil {
+			log.Println(err)
+		}
+		h.recordAttempt(request, u.Username, u, auth.ReasonBadMFACode)
+		problem.Error(writer, "Invalid MFA code", http.StatusUnauthorized)
+		return
+	}
+
+	h.completeLogin(writer, request, u.Username, u, true)
+}
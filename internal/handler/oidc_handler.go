@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/auth"
+	"auth-register-sistem/internal/model/user"
+	"auth-register-sistem/internal/oidc"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// oidcStateTTL is how long a user has to sign in at the provider
+const oidcStateTTL = 10 * time.Minute
+
+const oidcStateCookie = "oidc_state"
+
+// OIDCHandler signs users in through OpenID Connect providers, creating or
+// linking local accounts as needed. Sessions are then issued like a
+// password login, including the MFA step.
+type OIDCHandler struct {
+	Providers map[string]*oidc.Provider
+	Repo      repository.OIDCRepository
+	Users     *UserHandler
+}
+
+func NewOIDCHandler(providers []*oidc.Provider, repo repository.OIDCRepository, users *UserHandler) *OIDCHandler {
+	h := &OIDCHandler{Providers: make(map[string]*oidc.Provider), Repo: repo, Users: users}
+	for _, p := range providers {
+		h.Providers[p.Name()] = p
+	}
+	return h
+}
+
+func (h *OIDCHandler) provider(writer http.ResponseWriter, request *http.Request) (*oidc.Provider, bool) {
+	p, ok := h.Providers[request.PathValue("provider")]
+	if !ok {
+		problem.Error(writer, "Unknown identity provider", http.StatusNotFound)
+	}
+	return p, ok
+}
+
+// Login redirects the browser to the provider, remembering the state,
+// nonce and PKCE verifier of the attempt
+func (h *OIDCHandler) Login(writer http.ResponseWriter, request *http.Request) {
+	p, ok := h.provider(writer, request)
+	if !ok {
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		v, err := oidc.RandomString(32)
+		if err != nil {
+			problem.Error(writer, "Failed to start login", http.StatusInternalServerError)
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	if err := h.Repo.SaveState(request.Context(), state, p.Name(), nonce, verifier, oidcStateTTL); err != nil {
+		problem.Error(writer, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := p.AuthCodeURL(request.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Println(err)
+		problem.Error(writer, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// The cookie ties the callback to the browser that started the login
+	http.SetCookie(writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.Users.AppURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(writer, request, target, http.StatusFound)
+}
+
+// Callback finishes the authorization code flow and signs the user in
+func (h *OIDCHandler) Callback(writer http.ResponseWriter, request *http.Request) {
+	p, ok := h.provider(writer, request)
+	if !ok {
+		return
+	}
+
+	query := request.URL.Query()
+	if e := query.Get("error"); e != "" {
+		problem.Error(writer, "Identity provider returned an error: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := request.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		problem.Error(writer, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(writer, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc/", MaxAge: -1})
+
+	nonce, verifier, err := h.Repo.ConsumeState(request.Context(), state, p.Name())
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to check login state", http.StatusInternalServerError)
+		return
+	}
+
+	claims, err := p.Exchange(request.Context(), query.Get("code"), verifier, nonce)
+	if err != nil {
+		log.Println(err)
+		h.Users.recordAttempt(request, "oidc:"+p.Name(), nil, auth.ReasonBadIDToken)
+		problem.Error(writer, "Failed to sign in with the identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	u, status, message := h.resolveUser(request.Context(), p.Name(), claims, middleware.Actor(request.Context()))
+	if u == nil {
+		problem.Error(writer, message, status)
+		return
+	}
+
+	h.Users.startSession(writer, request, u.Username, u)
+}
+
+// resolveUser finds the account linked to the identity. Otherwise it links
+// the account with the same email, if both the provider and the account
+// verified that email, or provisions a new account. When no user is returned, status and
+// message describe the failure. New accounts are audited as made by actor.
+func (h *OIDCHandler) resolveUser(ctx context.Context, provider string, claims *oidc.Claims, actor audit.Actor) (*user.User, int, string) {
+	u, err := h.Repo.FindUserByIdentity(ctx, provider, claims.Subject)
+	if err == nil {
+		return u, 0, ""
+	} else if !errors.Is(err, repository.ErrNotFound) {
+		log.Println(err)
+		return nil, http.StatusInternalServerError, "Failed to find user"
+	}
+
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+	if user.ValidateEmail(email) != "" {
+		return nil, http.StatusBadRequest, "Identity provider did not share a valid email"
+	}
+
+	existing, err := h.Users.Repo.FindByEmail(ctx, email)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		log.Println(err)
+		return nil, http.StatusInternalServerError, "Failed to find user"
+	}
+	if existing != nil {
+		if !claims.EmailVerified {
+			return nil, http.StatusConflict, "An account with this email already exists; the provider must verify the email to link it"
+		}
+		// Whoever registered an unverified address may not own it, and
+		// would keep signing in to the linked account with their password
+		if existing.EmailVerifiedAt == nil {
+			return nil, http.StatusConflict, "An account with this email already exists; verify its email before signing in with a provider"
+		}
+		if err := h.Repo.LinkIdentity(ctx, existing.ID, provider, claims.Subject, email); err != nil {
+			log.Println(err)
+			return nil, http.StatusInternalServerError, "Failed to link identity"
+		}
+		return existing, 0, ""
+	}
+
+	newUser := user.User{
+		Name:  strings.TrimSpace(claims.Name),
+		Email: email,
+		// Not a valid bcrypt hash, so password login stays impossible
+		// until the user sets a password through a reset
+		Password: "!",
+	}
+	if claims.EmailVerified {
+		now := time.Now()
+		newUser.EmailVerifiedAt = &now
+	}
+
+	base := usernameFrom(claims.PreferredUsername, email)
+	if newUser.Name == "" {
+		newUser.Name = base
+	}
+
+	// Retry with a random suffix while the username is taken
+	for attempt := 0; attempt < 5; attempt++ {
+		newUser.Username = base
+		if attempt > 0 {
+			suffix, err := oidc.RandomString(3)
+			if err != nil {
+				return nil, http.StatusInternalServerError, "Failed to create user"
+			}
+			newUser.Username = fmt.Sprintf("%s-%s", base, strings.ToLower(suffix))
+		}
+
+		id, err := h.Repo.CreateUserWithIdentity(ctx, newUser, provider, claims.Subject, actor)
+		var dup *repository.UniqueViolationError
+		if errors.As(err, &dup) && dup.Field == "username" {
+			continue
+		} else if err != nil {
+			log.Println(err)
+			return nil, http.StatusInternalServerError, "Failed to create user"
+		}
+
+		created, err := h.Users.Repo.FindByID(ctx, id)
+		if err != nil {
+			log.Println("Failed to load provisioned user:", err)
+			return nil, http.StatusInternalServerError, "Failed to create user"
+		}
+		return created, 0, ""
+	}
+	return nil, http.StatusConflict, "Could not find a free username"
+}
+
+// usernameFrom derives a valid username from the preferred username or the
+// local part of the email
+func usernameFrom(preferred, email string) string {
+	candidate := preferred
+	if candidate == "" {
+		candidate, _, _ = strings.Cut(email, "@")
+	}
+
+	var b strings.Builder
+	for _, r := range candidate {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			b.WriteRune(r)
+		}
+		if b.Len() == 40 {
+			break
+		}
+	}
+
+	username := b.String()
+	for len(username) < 3 {
+		username += "_"
+	}
+	return username
+}
@@ -0,0 +1,387 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/org"
+	"auth-register-sistem/internal/model/user"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// OrgHandler manages organizations and their members, and issues tokens
+// for switching between the organizations a user belongs to.
+type OrgHandler struct {
+	Repo  repository.OrgRepository
+	Users *UserHandler
+}
+
+func NewOrgHandler(repo repository.OrgRepository, users *UserHandler) *OrgHandler {
+	return &OrgHandler{Repo: repo, Users: users}
+}
+
+// slugify lowercases name and joins its letters and digits with '-'
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// parseOrgID reads the {id} path segment
+func parseOrgID(writer http.ResponseWriter, request *http.Request) (uuid.UUID, bool) {
+	id, err := uuid.Parse(request.PathValue("id"))
+	if err != nil {
+		problem.Error(writer, "Invalid id format", http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// callerRole returns the caller's role in orgID. Platform admins act as
+// admins of every organization. Non-members get a 404 so organization ids
+// cannot be probed.
+func (h *OrgHandler) callerRole(writer http.ResponseWriter, request *http.Request, orgID uuid.UUID) (string, bool) {
+	userID, ok := callerID(writer, request)
+	if !ok {
+		return "", false
+	}
+
+	role, err := h.Repo.GetRole(request.Context(), orgID, userID)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Failed to find organization membership", http.StatusInternalServerError)
+		return "", false
+	}
+	if platformRole, _ := request.Context().Value(middleware.RoleKey).(string); platformRole == user.RoleAdmin {
+		role = org.RoleAdmin
+	}
+	if role == "" {
+		problem.Error(writer, "Organization not found", http.StatusNotFound)
+		return "", false
+	}
+	return role, true
+}
+
+// requireOrgAdmin is callerRole for actions only organization admins may
+// take
+func (h *OrgHandler) requireOrgAdmin(writer http.ResponseWriter, request *http.Request, orgID uuid.UUID) bool {
+	role, ok := h.callerRole(writer, request, orgID)
+	if !ok {
+		return false
+	}
+	if role != org.RoleAdmin {
+		problem.Error(writer, "Organization admin role required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// CreateOrg creates an organization with the caller as its admin
+func (h *OrgHandler) CreateOrg(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := callerID(writer, request)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	req.Slug = strings.ToLower(strings.TrimSpace(req.Slug))
+	if req.Slug == "" {
+		req.Slug = slugify(req.Name)
+	}
+
+	fields := make(map[string]string)
+	if req.Name == "" {
+		fields["name"] = "is required"
+	} else if len(req.Name) > 200 {
+		fields["name"] = "must be at most 200 characters long"
+	}
+	if !org.ValidSlug(req.Slug) {
+		fields["slug"] = "must be 3 to 50 lowercase letters, digits or inner '-'"
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(writer, http.StatusBadRequest, "Invalid organization", fields)
+		return
+	}
+
+	id, err := h.Repo.Create(request.Context(), org.Organization{Name: req.Name, Slug: req.Slug}, userID, middleware.Actor(request.Context()))
+	var dup *repository.UniqueViolationError
+	if errors.As(err, &dup) {
+		writeFieldErrors(writer, http.StatusConflict, "Organization already exists", map[string]string{
+			dup.Field: "is already taken",
+		})
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to create organization", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"id":      id,
+		"slug":    req.Slug,
+		"message": "Organization created successfully",
+	})
+}
+
+// ListOrgs lists the caller's organizations and their role in each
+func (h *OrgHandler) ListOrgs(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := callerID(writer, request)
+	if !ok {
+		return
+	}
+
+	orgs, err := h.Repo.ListForUser(request.Context(), userID)
+	if err != nil {
+		problem.Error(writer, "Failed to list organizations", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(orgs)
+}
+
+// SwitchOrg issues a token for working in another organization of the
+// caller. The token keeps the MFA status of the current one.
+func (h *OrgHandler) SwitchOrg(writer http.ResponseWriter, request *http.Request) {
+	orgID, ok := parseOrgID(writer, request)
+	if !ok {
+		return
+	}
+	userID, ok := callerID(writer, request)
+	if !ok {
+		return
+	}
+
+	// Platform admins still need to be members to work with the data
+	_, err := h.Repo.GetRole(request.Context(), orgID, userID)
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Organization not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to find organization membership", http.StatusInternalServerError)
+		return
+	}
+
+	mfa, _ := request.Context().Value(middleware.MFAKey).(bool)
+	tokenStr, err := h.Users.signAccessToken(userID, orgID, mfa)
+	if err != nil {
+		problem.Error(writer, "Failed to sign token", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]string{
+		"token":   tokenStr,
+		"org_id":  orgID.String(),
+		"message": "Switched organization",
+	})
+}
+
+// ListMembers lists the members of an organization the caller belongs to
+func (h *OrgHandler) ListMembers(writer http.ResponseWriter, request *http.Request) {
+	orgID, ok := parseOrgID(writer, request)
+	if !ok {
+		return
+	}
+	if _, ok := h.callerRole(writer, request, orgID); !ok {
+		return
+	}
+
+	members, err := h.Repo.ListMembers(request.Context(), orgID)
+	if err != nil {
+		problem.Error(writer, "Failed to list members", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(members)
+}
+
+// AddMember adds an existing account, found by username or email, to the
+// organization
+func (h *OrgHandler) AddMember(writer http.ResponseWriter, request *http.Request) {
+	orgID, ok := parseOrgID(writer, request)
+	if !ok {
+		return
+	}
+	if !h.requireOrgAdmin(writer, request, orgID) {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = org.RoleMember
+	}
+	if !org.ValidRole(req.Role) {
+		problem.Error(writer, "Role must be admin or member", http.StatusBadRequest)
+		return
+	}
+
+	var member *user.User
+	var err error
+	switch {
+	case strings.TrimSpace(req.Username) != "":
+		member, err = h.Users.Repo.FindByUsername(request.Context(), strings.TrimSpace(req.Username))
+	case strings.TrimSpace(req.Email) != "":
+		member, err = h.Users.Repo.FindByEmail(request.Context(), strings.ToLower(strings.TrimSpace(req.Email)))
+	default:
+		problem.Error(writer, "Username or email is required", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to find user", http.StatusInternalServerError)
+		return
+	}
+
+	err = h.Repo.AddMember(request.Context(), orgID, member.ID, req.Role, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrConflict) {
+		problem.ErrorCode(writer, "User is already a member", http.StatusConflict, problem.CodeAlreadyExists)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to add member", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"user_id": member.ID,
+		"role":    req.Role,
+		"message": "Member added successfully",
+	})
+}
+
+// parseMemberID reads the {user_id} path segment
+func parseMemberID(writer http.ResponseWriter, request *http.Request) (uuid.UUID, bool) {
+	id, err := uuid.Parse(request.PathValue("user_id"))
+	if err != nil {
+		problem.Error(writer, "Invalid user_id format", http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// writeMemberChangeError reports the errors of SetMemberRole and
+// RemoveMember, and returns false when there was none
+func writeMemberChangeError(writer http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		problem.Error(writer, "Member not found", http.StatusNotFound)
+	case errors.Is(err, repository.ErrConflict):
+		problem.Error(writer, "An organization needs at least one admin", http.StatusConflict)
+	case err != nil:
+		problem.Error(writer, "Failed to update member", http.StatusInternalServerError)
+	default:
+		return false
+	}
+	return true
+}
+
+// UpdateMember changes the role of a member
+func (h *OrgHandler) UpdateMember(writer http.ResponseWriter, request *http.Request) {
+	orgID, ok := parseOrgID(writer, request)
+	if !ok {
+		return
+	}
+	memberID, ok := parseMemberID(writer, request)
+	if !ok {
+		return
+	}
+	if !h.requireOrgAdmin(writer, request, orgID) {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !org.ValidRole(req.Role) {
+		problem.Error(writer, "Role must be admin or member", http.StatusBadRequest)
+		return
+	}
+
+	if writeMemberChangeError(writer, h.Repo.SetMemberRole(request.Context(), orgID, memberID, req.Role, middleware.Actor(request.Context()))) {
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]string{
+		"message": "Member updated successfully",
+	})
+}
+
+// RemoveMember removes a member. Members may also remove themselves to
+// leave the organization.
+func (h *OrgHandler) RemoveMember(writer http.ResponseWriter, request *http.Request) {
+	orgID, ok := parseOrgID(writer, request)
+	if !ok {
+		return
+	}
+	memberID, ok := parseMemberID(writer, request)
+	if !ok {
+		return
+	}
+
+	role, ok := h.callerRole(writer, request, orgID)
+	if !ok {
+		return
+	}
+	if userID, _ := callerID(writer, request); role != org.RoleAdmin && userID != memberID {
+		problem.Error(writer, "Organization admin role required", http.StatusForbidden)
+		return
+	}
+
+	if writeMemberChangeError(writer, h.Repo.RemoveMember(request.Context(), orgID, memberID, middleware.Actor(request.Context()))) {
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]string{
+		"message": "Member removed successfully",
+	})
+}
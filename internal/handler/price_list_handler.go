@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/pricing"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PriceListHandler struct {
+	Repo repository.PriceListRepository
+}
+
+func NewPriceListHandler(repo repository.PriceListRepository) *PriceListHandler {
+	return &PriceListHandler{Repo: repo}
+}
+
+// CreatePriceList creates a named price list
+func (h *PriceListHandler) CreatePriceList(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		Name      string     `json:"name"`
+		Currency  string     `json:"currency"`
+		ValidFrom *time.Time `json:"valid_from"`
+		ValidTo   *time.Time `json:"valid_to"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		problem.Error(writer, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Currency) != 3 {
+		problem.Error(writer, "Currency must be a 3-letter ISO 4217 code", http.StatusBadRequest)
+		return
+	}
+
+	if req.ValidFrom != nil && req.ValidTo != nil && !req.ValidFrom.Before(*req.ValidTo) {
+		problem.Error(writer, "valid_from must be before valid_to", http.StatusBadRequest)
+		return
+	}
+
+	id, err := h.Repo.CreatePriceList(request.Context(), middleware.OrgID(request.Context()), pricing.PriceList{
+		Name:      req.Name,
+		Currency:  strings.ToUpper(req.Currency),
+		ValidFrom: req.ValidFrom,
+		ValidTo:   req.ValidTo,
+		CreatedBy: middleware.ActorID(request.Context()),
+	}, middleware.Actor(request.Context()))
+	if err != nil {
+		writeError(writer, err, "Failed to create price list")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"id":      id,
+		"message": "Price list created successfully",
+	})
+}
+
+// GetAllPriceLists retrieves all price lists
+func (h *PriceListHandler) GetAllPriceLists(writer http.ResponseWriter, request *http.Request) {
+	lists, err := h.Repo.GetAllPriceLists(request.Context(), middleware.OrgID(request.Context()))
+	if err != nil {
+		writeError(writer, err, "Failed to get price lists")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(lists)
+}
+
+// SetPrices adds or updates product prices on a price list
+func (h *PriceListHandler) SetPrices(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		PriceListID uuid.UUID      `json:"price_list_id"`
+		Items       []pricing.Item `json:"items"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.PriceListID == uuid.Nil {
+		problem.Error(writer, "price_list_id is required", http.StatusBadRequest)
+		return
+	}
+
+	for _, item := range req.Items {
+		if item.ProductID == uuid.Nil {
+			problem.Error(writer, "product_id is required", http.StatusBadRequest)
+			return
+		}
+		if item.Price.IsNegative() {
+			problem.Error(writer, "Prices cannot be negative", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := h.Repo.SetPrices(request.Context(), middleware.OrgID(request.Context()), req.PriceListID, req.Items, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Price list or product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(writer, err, "Failed to set prices")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"price_list_id": req.PriceListID,
+		"message":       "Prices saved successfully",
+	})
+}
+
+// GetPrices lists the prices on a price list
+func (h *PriceListHandler) GetPrices(writer http.ResponseWriter, request *http.Request) {
+	id, err := uuid.Parse(request.URL.Query().Get("price_list_id"))
+	if err != nil {
+		problem.Error(writer, "Invalid price_list_id parameter", http.StatusBadRequest)
+		return
+	}
+
+	items, err := h.Repo.GetPrices(request.Context(), middleware.OrgID(request.Context()), id)
+	if err != nil {
+		writeError(writer, err, "Failed to get prices")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(items)
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type ReportHandler struct {
+	Repo repository.ReportRepository
+}
+
+func NewReportHandler(repo repository.ReportRepository) *ReportHandler {
+	return &ReportHandler{Repo: repo}
+}
+
+// parseTimeParam reads an optional RFC 3339 timestamp or YYYY-MM-DD date
+// query parameter
+func parseTimeParam(request *http.Request, name string) (sql.NullTime, bool) {
+	value := request.URL.Query().Get(name)
+	if value == "" {
+		return sql.NullTime{}, true
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return sql.NullTime{Time: t, Valid: true}, true
+		}
+	}
+	return sql.NullTime{}, false
+}
+
+// GetMarginReport reports revenue, cost and margin per product
+func (h *ReportHandler) GetMarginReport(writer http.ResponseWriter, request *http.Request) {
+	from, ok := parseTimeParam(request, "from")
+	if !ok {
+		problem.Error(writer, "Invalid from parameter", http.StatusBadRequest)
+		return
+	}
+
+	to, ok := parseTimeParam(request, "to")
+	if !ok {
+		problem.Error(writer, "Invalid to parameter", http.StatusBadRequest)
+		return
+	}
+
+	lines, err := h.Repo.GetMarginReport(request.Context(), middleware.OrgID(request.Context()), from, to)
+	if err != nil {
+		writeError(writer, err, "Failed to get margin report")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(lines)
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/rma"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+type ReturnHandler struct {
+	Repo repository.ReturnRepository
+}
+
+func NewReturnHandler(repo repository.ReturnRepository) *ReturnHandler {
+	return &ReturnHandler{Repo: repo}
+}
+
+// CreateReturn registers goods returned against an EXIT transaction
+func (h *ReturnHandler) CreateReturn(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		TransactionID uuid.UUID       `json:"transaction_id"`
+		Quantity      decimal.Decimal `json:"quantity"`
+		Restocked     decimal.Decimal `json:"restocked"`
+		Scrapped      decimal.Decimal `json:"scrapped"`
+		Quarantined   decimal.Decimal `json:"quarantined"`
+		Reason        string          `json:"reason"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.TransactionID == uuid.Nil {
+		problem.Error(writer, "transaction_id is required", http.StatusBadRequest)
+		return
+	}
+
+	if !req.Quantity.IsPositive() {
+		problem.Error(writer, "Quantity must be greater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// Every received unit must get exactly one inspection outcome
+	if req.Restocked.IsNegative() || req.Scrapped.IsNegative() || req.Quarantined.IsNegative() {
+		problem.Error(writer, "Inspection quantities cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if !req.Restocked.Add(req.Scrapped).Add(req.Quarantined).Equal(req.Quantity) {
+		problem.Error(writer, "Restocked, scrapped and quarantined must add up to quantity", http.StatusBadRequest)
+		return
+	}
+
+	id, err := h.Repo.CreateReturn(request.Context(), middleware.OrgID(request.Context()), rma.Return{
+		TransactionID: req.TransactionID,
+		Quantity:      req.Quantity,
+		Restocked:     req.Restocked,
+		Scrapped:      req.Scrapped,
+		Quarantined:   req.Quarantined,
+		Reason:        req.Reason,
+		CreatedBy:     middleware.ActorID(request.Context()),
+	}, middleware.Actor(request.Context()))
+	if err != nil {
+		writeError(writer, err, "Failed to create return")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"id":      id,
+		"message": "Return created successfully",
+	})
+}
+
+// GetAllReturns retrieves all returns
+func (h *ReturnHandler) GetAllReturns(writer http.ResponseWriter, request *http.Request) {
+	returns, err := h.Repo.GetAllReturns(request.Context(), middleware.OrgID(request.Context()))
+	if err != nil {
+		writeError(writer, err, "Failed to get returns")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(returns)
+}
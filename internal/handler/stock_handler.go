@@ -2,12 +2,21 @@ package handler
 
 import (
 	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/audit"
 	"auth-register-sistem/internal/model/stock"
+	"auth-register-sistem/internal/problem"
 	"auth-register-sistem/internal/repository"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
 )
 
 type StockHandler struct {
@@ -21,33 +30,36 @@ func NewStockHandler(repo repository.StockRepository) *StockHandler {
 func (h *StockHandler) CreateProduct(w http.ResponseWriter, r *http.Request) {
 	var req stock.Stock
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	
-	userIDVal := r.Context().Value(middleware.UserIDKey)
-	if userIDVal == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+	// Services write with a null created_by
+	req.CreatedBy = middleware.ActorID(r.Context())
+
+	if req.Precision < 0 || req.Precision > stock.MaxPrecision {
+		problem.Error(w, "Precision must be between 0 and 6", http.StatusBadRequest)
 		return
 	}
 
-	userID, ok := userIDVal.(string)
-	if !ok {
-		http.Error(w, "Invalid user ID in context", http.StatusUnauthorized)
+	if !stock.FitsPrecision(req.Quantity, req.Precision) {
+		problem.Error(w, "Quantity has more decimal places than the product precision allows", http.StatusBadRequest)
 		return
 	}
 
-	createdByUUID, err := uuid.Parse(userID)
-	if err != nil {
-		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+	if req.Currency != "" && len(req.Currency) != 3 {
+		problem.Error(w, "Currency must be a 3-letter ISO 4217 code", http.StatusBadRequest)
 		return
 	}
 
-	req.CreatedBy = createdByUUID
+	if negativePrice(req) {
+		problem.Error(w, "Prices cannot be negative", http.StatusBadRequest)
+		return
+	}
 
-	id, err := h.Repo.CreateProduct(req)
+	id, err := h.Repo.CreateProduct(r.Context(), middleware.OrgID(r.Context()), req, middleware.Actor(r.Context()))
 	if err != nil {
-		http.Error(w, "Failed to create product", http.StatusInternalServerError)
+		writeError(w, err, "Failed to create product")
 		return
 	}
 
@@ -59,9 +71,10 @@ func (h *StockHandler) CreateProduct(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *StockHandler) GetAllProducts(writer http.ResponseWriter, request *http.Request) {
-	products, err := h.Repo.GetAllProducts()
+	includeDeleted := request.URL.Query().Get("include_deleted") == "true"
+	products, err := h.Repo.GetAllProducts(request.Context(), middleware.OrgID(request.Context()), request.URL.Query().Get("price_list"), includeDeleted)
 	if err != nil {
-		http.Error(writer, "Failed to get products", http.StatusInternalServerError)
+		writeError(writer, err, "Failed to get products")
 		return
 	}
 
@@ -70,35 +83,273 @@ func (h *StockHandler) GetAllProducts(writer http.ResponseWriter, request *http.
 	json.NewEncoder(writer).Encode(products)
 }
 
-func (h *StockHandler) UpdateProductById(writer http.ResponseWriter, request *http.Request) {
-	idStr := request.URL.Query().Get("id")
+// productIDParam reads the product id from the {id} path segment, falling
+// back to the legacy ?id= query parameter
+func productIDParam(writer http.ResponseWriter, request *http.Request) (uuid.UUID, bool) {
+	idStr := request.PathValue("id")
 	if idStr == "" {
-		http.Error(writer, "Missing id parameter", http.StatusBadRequest)
-		return
+		idStr = request.URL.Query().Get("id")
+	}
+	if idStr == "" {
+		problem.Error(writer, "Missing id parameter", http.StatusBadRequest)
+		return uuid.Nil, false
 	}
 
 	id, err := uuid.Parse(idStr)
 	if err != nil {
-		http.Error(writer, "Invalid id format", http.StatusBadRequest)
+		problem.Error(writer, "Invalid id format", http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// productETag formats a product version as a strong entity tag. The
+// quantity of a parent sums its variants, which have versions of their
+// own, so the tag of a parent also carries a hash of the variant versions
+// and changes whenever one of them does.
+func productETag(version int, variants []stock.Stock) string {
+	tag := strconv.Itoa(version)
+	if len(variants) > 0 {
+		h := fnv.New64a()
+		for _, v := range variants {
+			fmt.Fprintf(h, "%s:%d;", v.ID, v.Version)
+		}
+		tag += "-" + strconv.FormatUint(h.Sum64(), 16)
+	}
+	return `"` + tag + `"`
+}
+
+// ifMatchVersion reads the product version the client based its change on
+// from the If-Match header. "*" matches any version and is returned as 0.
+// Only the version part of a parent's tag is compared, as writes to the
+// parent do not touch its variants. A missing header is answered with 428
+// and a malformed one with 412.
+func ifMatchVersion(writer http.ResponseWriter, request *http.Request) (int, bool) {
+	ifMatch := strings.TrimSpace(request.Header.Get("If-Match"))
+	if ifMatch == "" {
+		problem.Error(writer, "If-Match header is required", http.StatusPreconditionRequired)
+		return 0, false
+	}
+	if ifMatch == "*" {
+		return 0, true
+	}
+
+	versionPart, _, _ := strings.Cut(strings.Trim(ifMatch, `"`), "-")
+	version, err := strconv.Atoi(versionPart)
+	if err != nil || version <= 0 || !strings.HasPrefix(ifMatch, `"`) {
+		problem.Error(writer, "If-Match does not match the current version", http.StatusPreconditionFailed)
+		return 0, false
+	}
+	return version, true
+}
+
+// writeVersionedError answers the errors of versioned writes
+func writeVersionedError(writer http.ResponseWriter, err error, message string) {
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Product not found", http.StatusNotFound)
+		return
+	}
+	writeError(writer, err, message)
+}
+
+func (h *StockHandler) GetProductById(writer http.ResponseWriter, request *http.Request) {
+	id, ok := productIDParam(writer, request)
+	if !ok {
+		return
+	}
+
+	includeDeleted := request.URL.Query().Get("include_deleted") == "true"
+	product, err := h.Repo.GetProductById(request.Context(), middleware.OrgID(request.Context()), id, includeDeleted)
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(writer, err, "Failed to get product")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("ETag", productETag(product.Version, product.Variants))
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(product)
+}
+
+func (h *StockHandler) UpdateProductById(writer http.ResponseWriter, request *http.Request) {
+	id, ok := productIDParam(writer, request)
+	if !ok {
+		return
+	}
+
+	version, ok := ifMatchVersion(writer, request)
+	if !ok {
 		return
 	}
 
 	var req stock.Stock
 	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
-		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
 	req.ID = id
+	req.Version = version
+
+	if req.Name == "" {
+		problem.Error(writer, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Quantity.IsNegative() {
+		problem.Error(writer, "Quantity cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	if negativePrice(req) {
+		problem.Error(writer, "Prices cannot be negative", http.StatusBadRequest)
+		return
+	}
 
-	updatedId, err := h.Repo.UpdateProductById(req)
+	updatedId, err := h.Repo.UpdateProductById(request.Context(), middleware.OrgID(request.Context()), req, middleware.Actor(request.Context()))
 	if err != nil {
-		http.Error(writer, "Failed to update product", http.StatusInternalServerError)
+		writeVersionedError(writer, err, "Failed to update product")
 		return
 	}
 
+	writer.Header().Set("Content-Type", "application/json")
+	if version != 0 {
+		writer.Header().Set("ETag", productETag(version+1, nil))
+	}
 	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"id":      updatedId,
+		"message": "Product updated successfully",
+	})
+}
+
+// stockPatch holds the product fields a merge patch may change
+type stockPatch struct {
+	Name      string              `json:"name"`
+	SKU       *string             `json:"sku"`
+	BaseUnit  string              `json:"base_unit"`
+	Precision int                 `json:"precision"`
+	Quantity  decimal.Decimal     `json:"quantity"`
+	Currency  string              `json:"currency"`
+	SalePrice decimal.NullDecimal `json:"sale_price"`
+	CostPrice decimal.NullDecimal `json:"cost_price"`
+}
+
+// PatchProductById applies a JSON merge patch (RFC 7396) to a product
+func (h *StockHandler) PatchProductById(writer http.ResponseWriter, request *http.Request) {
+	id, ok := productIDParam(writer, request)
+	if !ok {
+		return
+	}
+
+	version, ok := ifMatchVersion(writer, request)
+	if !ok {
+		return
+	}
+
+	patch, err := io.ReadAll(request.Body)
+	if err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	current, err := h.Repo.GetProductById(request.Context(), middleware.OrgID(request.Context()), id, false)
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(writer, err, "Failed to get product")
+		return
+	}
+
+	if version != 0 && version != current.Version {
+		problem.Error(writer, "Product was modified, fetch it again and retry", http.StatusPreconditionFailed)
+		return
+	}
+
+	// The stored quantity of a parent excludes what its variants hold
+	ownQuantity := current.Quantity
+	for _, v := range current.Variants {
+		ownQuantity = ownQuantity.Sub(v.Quantity)
+	}
+
+	fields := stockPatch{
+		Name:      current.Name,
+		SKU:       &current.SKU,
+		BaseUnit:  current.BaseUnit,
+		Precision: current.Precision,
+		Quantity:  ownQuantity,
+		Currency:  current.Currency,
+		SalePrice: current.SalePrice,
+		CostPrice: current.CostPrice,
+	}
+	if err := applyMergePatch(&fields, patch); err != nil {
+		problem.Error(writer, "Invalid merge patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if fields.Name == "" || fields.BaseUnit == "" {
+		problem.Error(writer, "Name and base_unit are required", http.StatusBadRequest)
+		return
+	}
+
+	if len(current.Variants) > 0 && !fields.Quantity.Equal(ownQuantity) {
+		problem.Error(writer, "Stock is held per variant, patch the variant quantity instead", http.StatusBadRequest)
+		return
+	}
+
+	if fields.Precision < 0 || fields.Precision > stock.MaxPrecision {
+		problem.Error(writer, "Precision must be between 0 and 6", http.StatusBadRequest)
+		return
+	}
+
+	if fields.Quantity.IsNegative() || !stock.FitsPrecision(fields.Quantity, fields.Precision) {
+		problem.Error(writer, "Quantity must be non-negative and fit the product precision", http.StatusBadRequest)
+		return
+	}
+
+	if len(fields.Currency) != 3 {
+		problem.Error(writer, "Currency must be a 3-letter ISO 4217 code", http.StatusBadRequest)
+		return
+	}
+
+	// A null SKU clears it, like an empty one
+	sku := ""
+	if fields.SKU != nil {
+		sku = *fields.SKU
+	}
+
+	updated := stock.Stock{
+		ID:        id,
+		Name:      fields.Name,
+		SKU:       sku,
+		BaseUnit:  fields.BaseUnit,
+		Precision: fields.Precision,
+		Quantity:  fields.Quantity,
+		Currency:  strings.ToUpper(fields.Currency),
+		SalePrice: fields.SalePrice,
+		CostPrice: fields.CostPrice,
+		Version:   current.Version,
+	}
+	if negativePrice(updated) {
+		problem.Error(writer, "Prices cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	// The patch was computed from current, so it only applies on top of
+	// that version even when If-Match was "*"
+	updatedId, err := h.Repo.PatchProductById(request.Context(), middleware.OrgID(request.Context()), updated, middleware.Actor(request.Context()))
+	if err != nil {
+		writeVersionedError(writer, err, "Failed to update product")
+		return
+	}
+
 	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("ETag", productETag(current.Version+1, current.Variants))
+	writer.WriteHeader(http.StatusOK)
 	json.NewEncoder(writer).Encode(map[string]interface{}{
 		"id":      updatedId,
 		"message": "Product updated successfully",
@@ -106,27 +357,290 @@ func (h *StockHandler) UpdateProductById(writer http.ResponseWriter, request *ht
 }
 
 func (h *StockHandler) DeleteProductById(writer http.ResponseWriter, request *http.Request) {
-	idStr := request.URL.Query().Get("id")
-	if idStr == "" {
-		http.Error(writer, "Missing id parameter", http.StatusBadRequest)
+	id, ok := productIDParam(writer, request)
+	if !ok {
 		return
 	}
 
-	id, err := uuid.Parse(idStr)
+	version, ok := ifMatchVersion(writer, request)
+	if !ok {
+		return
+	}
+
+	err := h.Repo.DeleteProductById(request.Context(), middleware.OrgID(request.Context()), id, version, middleware.Actor(request.Context()))
 	if err != nil {
-		http.Error(writer, "Invalid id format", http.StatusBadRequest)
+		writeVersionedError(writer, err, "Failed to delete product")
 		return
 	}
 
-	err = h.Repo.DeleteProductById(id.String())
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"message": "Product deleted successfully",
+	})
+}
+
+// RestoreProductById undoes the soft delete of a product
+func (h *StockHandler) RestoreProductById(writer http.ResponseWriter, request *http.Request) {
+	id, ok := productIDParam(writer, request)
+	if !ok {
+		return
+	}
+
+	err := h.Repo.RestoreProductById(request.Context(), middleware.OrgID(request.Context()), id, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Deleted product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(writer, err, "Failed to restore product")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"id":      id,
+		"message": "Product restored successfully",
+	})
+}
+
+// ArchiveProductById marks a deleted product as archived so it can be purged
+func (h *StockHandler) ArchiveProductById(writer http.ResponseWriter, request *http.Request) {
+	id, ok := productIDParam(writer, request)
+	if !ok {
+		return
+	}
+
+	err := h.Repo.ArchiveProductById(request.Context(), middleware.OrgID(request.Context()), id, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Deleted, unarchived product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(writer, err, "Failed to archive product")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"id":      id,
+		"message": "Product archived successfully",
+	})
+}
+
+// PurgeProductById permanently removes a deleted product
+func (h *StockHandler) PurgeProductById(writer http.ResponseWriter, request *http.Request) {
+	id, ok := productIDParam(writer, request)
+	if !ok {
+		return
+	}
+
+	err := h.Repo.PurgeProductById(request.Context(), middleware.OrgID(request.Context()), id, middleware.Actor(request.Context()))
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		problem.Error(writer, "Deleted product not found", http.StatusNotFound)
+		return
+	case err != nil:
+		writeError(writer, err, "Failed to purge product")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"message": "Product purged successfully",
+	})
+}
+
+// negativePrice reports whether s has a negative sale or cost price
+func negativePrice(s stock.Stock) bool {
+	return (s.SalePrice.Valid && s.SalePrice.Decimal.IsNegative()) ||
+		(s.CostPrice.Valid && s.CostPrice.Decimal.IsNegative())
+}
+
+func (h *StockHandler) CreateVariants(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		ParentID   uuid.UUID           `json:"parent_id"`
+		Attributes map[string][]string `json:"attributes"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ParentID == uuid.Nil {
+		problem.Error(writer, "parent_id is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Attributes) == 0 {
+		problem.Error(writer, "At least one attribute is required", http.StatusBadRequest)
+		return
+	}
+	combinations := 1
+	for name, values := range req.Attributes {
+		if name == "" || len(values) == 0 {
+			problem.Error(writer, "Every attribute needs a name and at least one value", http.StatusBadRequest)
+			return
+		}
+		combinations *= len(values)
+		if combinations > stock.MaxVariants {
+			problem.Error(writer, fmt.Sprintf("At most %d variants can be created at once", stock.MaxVariants), http.StatusBadRequest)
+			return
+		}
+		for _, value := range values {
+			if value == "" {
+				problem.Error(writer, "Attribute values cannot be empty", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	variants, err := h.Repo.CreateVariants(request.Context(), middleware.OrgID(request.Context()), req.ParentID, req.Attributes, middleware.Actor(request.Context()))
+	if err != nil {
+		writeError(writer, err, "Failed to create variants")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(variants)
+}
+
+func (h *StockHandler) SetUnits(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		ProductID uuid.UUID    `json:"product_id"`
+		BaseUnit  string       `json:"base_unit"`
+		Units     []stock.Unit `json:"units"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ProductID == uuid.Nil {
+		problem.Error(writer, "product_id is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.BaseUnit == "" {
+		problem.Error(writer, "base_unit is required", http.StatusBadRequest)
+		return
+	}
+
+	seen := map[string]bool{req.BaseUnit: true}
+	for _, u := range req.Units {
+		if u.Name == "" || seen[u.Name] {
+			problem.Error(writer, "Unit names must be unique and differ from the base unit", http.StatusBadRequest)
+			return
+		}
+		if !u.Factor.IsPositive() {
+			problem.Error(writer, "Unit factor must be greater than zero", http.StatusBadRequest)
+			return
+		}
+		seen[u.Name] = true
+	}
+
+	err := h.Repo.SetUnits(request.Context(), middleware.OrgID(request.Context()), req.ProductID, req.BaseUnit, req.Units, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(writer, err, "Failed to save units")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"product_id": req.ProductID,
+		"message":    "Units saved successfully",
+	})
+}
+
+func (h *StockHandler) GetUnits(writer http.ResponseWriter, request *http.Request) {
+	productID, err := uuid.Parse(request.URL.Query().Get("product_id"))
+	if err != nil {
+		problem.Error(writer, "Invalid product_id parameter", http.StatusBadRequest)
+		return
+	}
+
+	units, err := h.Repo.GetUnits(request.Context(), middleware.OrgID(request.Context()), productID)
 	if err != nil {
-		http.Error(writer, "Failed to delete product", http.StatusInternalServerError)
+		writeError(writer, err, "Failed to get units")
 		return
 	}
 
+	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(units)
+}
+
+// GetHistory lists every version of a product, newest first. With ?from=
+// it instead compares version from with version ?to=, or with the current
+// version when to is not given.
+func (h *StockHandler) GetHistory(writer http.ResponseWriter, request *http.Request) {
+	id, ok := productIDParam(writer, request)
+	if !ok {
+		return
+	}
+
+	revisions, err := h.Repo.GetHistory(request.Context(), middleware.OrgID(request.Context()), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(writer, err, "Failed to get product history")
+		return
+	}
+
+	query := request.URL.Query()
+	if query.Get("from") == "" {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(revisions)
+		return
+	}
+
+	from, err := strconv.Atoi(query.Get("from"))
+	if err != nil {
+		problem.Error(writer, "Invalid from parameter", http.StatusBadRequest)
+		return
+	}
+	to := revisions[0].Version
+	if v := query.Get("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil {
+			problem.Error(writer, "Invalid to parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	versions := make(map[int]stock.Revision, len(revisions))
+	for _, rev := range revisions {
+		versions[rev.Version] = rev
+	}
+	older, ok := versions[from]
+	if !ok {
+		problem.Error(writer, "Version "+strconv.Itoa(from)+" not found", http.StatusNotFound)
+		return
+	}
+	newer, ok := versions[to]
+	if !ok {
+		problem.Error(writer, "Version "+strconv.Itoa(to)+" not found", http.StatusNotFound)
+		return
+	}
+
+	changes, err := audit.Diff(older.Product, newer.Product)
+	if err != nil {
+		writeError(writer, err, "Failed to compare versions")
+		return
+	}
+
 	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
 	json.NewEncoder(writer).Encode(map[string]interface{}{
-		"message": "Product deleted successfully",
+		"from":    older,
+		"to":      newer,
+		"changes": changes,
 	})
 }
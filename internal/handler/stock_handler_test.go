@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"auth-register-sistem/internal/model/stock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestProductETagFollowsVariants(t *testing.T) {
+	variants := []stock.Stock{{ID: uuid.New(), Version: 1}, {ID: uuid.New(), Version: 4}}
+	tag := productETag(3, variants)
+
+	if got := productETag(3, nil); got != `"3"` {
+		t.Errorf("tag without variants = %s, want \"3\"", got)
+	}
+	if productETag(3, variants) != tag {
+		t.Error("tag is not stable")
+	}
+
+	variants[1].Version++
+	if productETag(3, variants) == tag {
+		t.Error("tag did not change with a variant version")
+	}
+	if productETag(3, variants[:1]) == tag {
+		t.Error("tag did not change when a variant went away")
+	}
+}
+
+func TestIfMatchVersion(t *testing.T) {
+	parentTag := productETag(7, []stock.Stock{{ID: uuid.New(), Version: 2}})
+
+	tests := []struct {
+		ifMatch string
+		version int
+		status  int
+	}{
+		{`"7"`, 7, 0},
+		{parentTag, 7, 0},
+		{`*`, 0, 0},
+		{``, 0, http.StatusPreconditionRequired},
+		{`7`, 0, http.StatusPreconditionFailed},
+		{`"0"`, 0, http.StatusPreconditionFailed},
+		{`"seven"`, 0, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodPatch, "/stock/x", nil)
+		if tt.ifMatch != "" {
+			request.Header.Set("If-Match", tt.ifMatch)
+		}
+		recorder := httptest.NewRecorder()
+
+		version, ok := ifMatchVersion(recorder, request)
+		if ok != (tt.status == 0) || version != tt.version {
+			t.Errorf("If-Match %s = %d, %v, want %d", tt.ifMatch, version, ok, tt.version)
+		}
+		if !ok && recorder.Code != tt.status {
+			t.Errorf("If-Match %s answered %d, want %d", tt.ifMatch, recorder.Code, tt.status)
+		}
+	}
+}
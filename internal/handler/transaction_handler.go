@@ -3,11 +3,12 @@ package handler
 import (
 	"auth-register-sistem/internal/middleware"
 	"auth-register-sistem/internal/model/transaction"
+	"auth-register-sistem/internal/problem"
 	"auth-register-sistem/internal/repository"
 	"encoding/json"
 	"net/http"
 
-	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
 )
 
 type TransactionHandler struct {
@@ -19,86 +20,82 @@ func NewTransactionHandler(repo repository.TransactionRepository) *TransactionHa
 }
 
 // CreateTransaction handles the creation of a new transaction
-func (h *TransactionHandler) CreateTransaction(w http.ResponseWriter, r *http.Request) {
-	userIDVal := r.Context().Value(middleware.UserIDKey)
-	if userIDVal == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Get user ID from context
-	userID, ok := userIDVal.(string)
-	if !ok {
-		http.Error(w, "Invalid user ID in context", http.StatusUnauthorized)
-		return
-	}
-
+func (h *TransactionHandler) CreateTransaction(writer http.ResponseWriter, request *http.Request) {
 	// Parse request body
 	var req struct {
-		Name	 string `json:"name"`
-		Quantity int    `json:"quantity"`
-		Type     string `json:"type"`
+		Name      string              `json:"name"`
+		Quantity  decimal.Decimal     `json:"quantity"`
+		Unit      string              `json:"unit"`
+		UnitPrice decimal.NullDecimal `json:"unit_price"`
+		Type      string              `json:"type"`
 	}
 
 	// Decode JSON body
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
 	// Validate transaction type
 	if req.Type != "ENTRY" && req.Type != "EXIT" {
-		http.Error(w, "Invalid transaction type", http.StatusBadRequest)
+		problem.Error(writer, "Invalid transaction type", http.StatusBadRequest)
 		return
 	}
 
 	//validate quantity
-	if req.Quantity <= 0 {
-		http.Error(w, "Quantity must be greater than zero", http.StatusBadRequest)
+	if !req.Quantity.IsPositive() {
+		problem.Error(writer, "Quantity must be greater than zero", http.StatusBadRequest)
 		return
 	}
 
 	//validate name
 	if req.Name == "" {
-		http.Error(w, "Name is required", http.StatusBadRequest)
+		problem.Error(writer, "Name is required", http.StatusBadRequest)
 		return
 	}
 
-	// Create transaction model
+	//validate unit price
+	if req.UnitPrice.Valid && req.UnitPrice.Decimal.IsNegative() {
+		problem.Error(writer, "Unit price cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	// Create transaction model; quantities in another unit are converted
+	// to the product's base unit by the repository
 	transactionData := transaction.Transaction{
-		Name:      req.Name,
-		Quantity:  req.Quantity,
-		Type:      transaction.TransactionType(req.Type),
-		CreatedBy: uuid.MustParse(userID),
+		Name:         req.Name,
+		Quantity:     req.Quantity,
+		Unit:         req.Unit,
+		UnitQuantity: req.Quantity,
+		UnitPrice:    req.UnitPrice,
+		Type:         transaction.TransactionType(req.Type),
+		CreatedBy:    middleware.ActorID(request.Context()),
 	}
 
 	// Call repository to create transaction
-	id, err := h.Repo.CreateTransaction(transactionData)
+	id, err := h.Repo.CreateTransaction(request.Context(), middleware.OrgID(request.Context()), transactionData, middleware.Actor(request.Context()))
 	if err != nil {
-		http.Error(w, "Failed to create transaction: "+err.Error(), http.StatusInternalServerError)
+		writeError(writer, err, "Failed to create transaction")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
 		"id":      id,
 		"message": "Transaction created successfully",
 	})
 }
 
 // GetAllTransactions retrieves all transactions
-func (h *TransactionHandler) GetAllTransactions(w http.ResponseWriter, r *http.Request) {
-	transactions, err := h.Repo.GetAllTransactions()
+func (h *TransactionHandler) GetAllTransactions(writer http.ResponseWriter, request *http.Request) {
+	transactions, err := h.Repo.GetAllTransactions(request.Context(), middleware.OrgID(request.Context()))
 	if err != nil {
-		http.Error(w, "Failed to get transactions", http.StatusInternalServerError)
+		writeError(writer, err, "Failed to get transactions")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(transactions); err != nil {
-		http.Error(w, "Failed to encode transactions: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-}
\ No newline at end of file
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(transactions)
+}
@@ -1,49 +1,111 @@
 package handler
 
 import (
+	"auth-register-sistem/internal/config"
+	"auth-register-sistem/internal/jwtauth"
+	"auth-register-sistem/internal/mailer"
+	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/auth"
 	"auth-register-sistem/internal/model/user"
+	"auth-register-sistem/internal/password"
+	"auth-register-sistem/internal/problem"
 	"auth-register-sistem/internal/repository"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type UserHandler struct {
-	Repo repository.UserRepository
+	Repo     repository.UserRepository
+	Tokens   repository.TokenRepository
+	Attempts repository.AuthAttemptRepository
+	MFA      repository.MFARepository
+	Orgs     repository.OrgRepository
+	JWT      *jwtauth.Manager
+	Policy   *password.Policy
+	Mailer   mailer.Mailer
+	// AppURL is the base URL of the links in account emails
+	AppURL string
+	// RequireVerification blocks login until the email is verified
+	RequireVerification bool
+	// How long the links of account emails stay valid
+	PasswordResetTTL     time.Duration
+	EmailVerificationTTL time.Duration
+	Throttle             config.LoginConfig
 }
 
-func NewUserHandler(repo repository.UserRepository) *UserHandler {
-	return &UserHandler{Repo: repo}
+func NewUserHandler(repo repository.UserRepository, tokens repository.TokenRepository, attempts repository.AuthAttemptRepository, mfa repository.MFARepository, orgs repository.OrgRepository, jwtManager *jwtauth.Manager, policy *password.Policy, mail mailer.Mailer, mailCfg *config.MailConfig, loginCfg *config.LoginConfig) *UserHandler {
+	return &UserHandler{
+		Repo:                 repo,
+		Tokens:               tokens,
+		Attempts:             attempts,
+		MFA:                  mfa,
+		Orgs:                 orgs,
+		JWT:                  jwtManager,
+		Policy:               policy,
+		Mailer:               mail,
+		AppURL:               strings.TrimRight(mailCfg.AppURL, "/"),
+		RequireVerification:  mailCfg.RequireVerification,
+		PasswordResetTTL:     mailCfg.PasswordResetTTL,
+		EmailVerificationTTL: mailCfg.EmailVerificationTTL,
+		Throttle:             *loginCfg,
+	}
 }
 
 // Register new users
 func (h *UserHandler) Register(writer http.ResponseWriter, request *http.Request) {
-	var req user.User
-	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
-		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+	var req user.RegisterRequest
+	decoder := json.NewDecoder(request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Normalize()
+	fields := req.Validate()
+	if _, ok := fields["password"]; !ok {
+		if problems := h.Policy.Validate(req.Password); len(problems) > 0 {
+			fields["password"] = strings.Join(problems, "; ")
+		}
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(writer, http.StatusBadRequest, "Validation failed", fields)
 		return
 	}
 
 	//Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(strings.TrimSpace(req.Password)), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(writer, "Failed to hash password", http.StatusInternalServerError)
+		problem.Error(writer, "Failed to hash password", http.StatusInternalServerError)
 		return
 	}
-	req.Password = string(hashedPassword)
 
-	id, err := h.Repo.Create(req)
-	if err != nil {
-		http.Error(writer, "Failed to create user", http.StatusInternalServerError)
+	id, err := h.Repo.Create(request.Context(), user.User{
+		Name:     req.Name,
+		Username: req.Username,
+		Email:    req.Email,
+		Password: string(hashedPassword),
+	}, middleware.Actor(request.Context()))
+	if writeUniqueViolation(writer, err) {
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
 
+	h.sendVerification(request.Context(), id, req.Name, req.Email)
+
 	writer.WriteHeader(http.StatusCreated)
 	json.NewEncoder(writer).Encode(map[string]interface{}{
 		"id":      id,
@@ -51,6 +113,51 @@ func (h *UserHandler) Register(writer http.ResponseWriter, request *http.Request
 	})
 }
 
+// dummyHash is compared against when the username is unknown, so that
+// failures take as long whether or not the account exists
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// clientIP returns the address of the caller
+func (h *UserHandler) clientIP(request *http.Request) string {
+	return middleware.ClientIP(request, h.Throttle.TrustProxy)
+}
+
+// loginDelay grows exponentially with the number of recent failures
+func (h *UserHandler) loginDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := h.Throttle.BaseDelay
+	for i := 1; i < failures && delay < h.Throttle.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, h.Throttle.MaxDelay)
+}
+
+func (h *UserHandler) recordAttempt(request *http.Request, username string, u *user.User, reason string) {
+	attempt := auth.Attempt{
+		Username:  username,
+		IP:        h.clientIP(request),
+		UserAgent: request.UserAgent(),
+		Success:   reason == auth.ReasonSuccess || reason == auth.ReasonMFAChallenge,
+		Reason:    reason,
+	}
+	if u != nil {
+		attempt.UserID = uuid.NullUUID{UUID: u.ID, Valid: true}
+	}
+	// Failures are recorded even if the caller hangs up before the answer,
+	// so dropping the connection does not dodge the throttling
+	if err := h.Attempts.Record(context.WithoutCancel(request.Context()), attempt); err != nil {
+		log.Println(err)
+	}
+}
+
+// loginFailed is the single answer for unknown users, wrong passwords and
+// locked accounts, so it does not reveal which usernames exist
+func loginFailed(writer http.ResponseWriter) {
+	problem.Error(writer, "Invalid username or password", http.StatusUnauthorized)
+}
+
 // Login existing users
 func (h *UserHandler) Login(writer http.ResponseWriter, request *http.Request) {
 	var req struct {
@@ -59,52 +166,393 @@ func (h *UserHandler) Login(writer http.ResponseWriter, request *http.Request) {
 	}
 
 	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
-		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	userData, err := h.Repo.FindByUsername(req.Username)
+	ipFailures, err := h.Attempts.CountFailuresByIP(request.Context(), h.clientIP(request), h.Throttle.IPWindow)
 	if err != nil {
-		http.Error(writer, "Failed to find user", http.StatusNotFound)
+		problem.Error(writer, "Failed to check login attempts", http.StatusInternalServerError)
+		return
+	}
+	if ipFailures >= h.Throttle.IPMaxFailures {
+		h.recordAttempt(request, req.Username, nil, auth.ReasonRateLimited)
+		writer.Header().Set("Retry-After", strconv.Itoa(int(h.Throttle.IPWindow.Seconds())))
+		problem.Error(writer, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
 		return
 	}
 
-	if userData == nil {
-		http.Error(writer, "Invalid credentials", http.StatusUnauthorized)
+	userData, err := h.Repo.FindByUsername(request.Context(), req.Username)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Failed to find user", http.StatusInternalServerError)
 		return
 	}
 
-	// Check password
-	if err := bcrypt.CompareHashAndPassword([]byte(userData.Password), []byte(strings.TrimSpace(req.Password))); err != nil {
-		http.Error(writer, "Invalid password", http.StatusUnauthorized)
-		log.Println(err)
+	// Slow down repeated guessing from the same IP or against the same account
+	failures := ipFailures
+	if userData != nil {
+		failures = max(failures, userData.FailedLogins)
+	}
+	select {
+	case <-time.After(h.loginDelay(failures)):
+	case <-request.Context().Done():
 		return
-	} else {
-		log.Println("Login successful")
 	}
 
-	//Generate JWT
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		http.Error(writer, "JWT secret not found", http.StatusInternalServerError)
+	hash := dummyHash
+	if userData != nil {
+		hash = []byte(userData.Password)
+	}
+	passwordErr := bcrypt.CompareHashAndPassword(hash, []byte(strings.TrimSpace(req.Password)))
+
+	switch {
+	case userData == nil:
+		h.recordAttempt(request, req.Username, nil, auth.ReasonUnknownUser)
+		loginFailed(writer)
+		return
+	case userData.Locked:
+		h.recordAttempt(request, req.Username, userData, auth.ReasonLocked)
+		loginFailed(writer)
+		return
+	case passwordErr != nil:
+		if err := h.Repo.RegisterFailedLogin(context.WithoutCancel(request.Context()), userData.ID, h.Throttle.MaxFailures, h.Throttle.Lockout); err != nil {
+			log.Println(err)
+		}
+		h.recordAttempt(request, req.Username, userData, auth.ReasonBadPassword)
+		loginFailed(writer)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": userData.ID.String(),
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
-	})
+	h.startSession(writer, request, req.Username, userData)
+}
+
+// startSession checks that an authenticated account may sign in and answers
+// with an access token, or with an MFA challenge when MFA is enabled.
+func (h *UserHandler) startSession(writer http.ResponseWriter, request *http.Request, username string, u *user.User) {
+	if u.DisabledAt != nil {
+		h.recordAttempt(request, username, u, auth.ReasonDisabled)
+		problem.Error(writer, "Account is disabled", http.StatusForbidden)
+		return
+	}
 
-	tokenStr, err := token.SignedString([]byte(secret))
+	if h.RequireVerification && u.EmailVerifiedAt == nil {
+		h.recordAttempt(request, username, u, auth.ReasonUnverified)
+		problem.Error(writer, "Email is not verified", http.StatusForbidden)
+		return
+	}
+
+	// With MFA on, the first factor only earns a short-lived challenge token
+	// that LoginMFA exchanges for an access token
+	if u.MFAEnabledAt != nil {
+		challenge, err := h.JWT.Sign(jwt.MapClaims{
+			"user_id": u.ID.String(),
+			"typ":     middleware.TokenTypeMFAChallenge,
+		}, h.Throttle.MFAChallengeTTL)
+		if err != nil {
+			problem.Error(writer, "Failed to sign token", http.StatusInternalServerError)
+			return
+		}
+
+		h.recordAttempt(request, username, u, auth.ReasonMFAChallenge)
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"message":      "MFA code required",
+		})
+		return
+	}
+
+	h.completeLogin(writer, request, username, u, false)
+}
+
+// completeLogin clears the failure counter and answers with an access token
+// for the first organization the user joined. mfa records whether the login
+// was confirmed with a second factor.
+func (h *UserHandler) completeLogin(writer http.ResponseWriter, request *http.Request, username string, u *user.User, mfa bool) {
+	if u.FailedLogins > 0 || u.LockedUntil != nil {
+		if err := h.Repo.ResetFailedLogins(request.Context(), u.ID); err != nil {
+			log.Println(err)
+		}
+	}
+
+	orgID, err := h.Orgs.DefaultForUser(request.Context(), u.ID)
 	if err != nil {
-		http.Error(writer, "Failed to sign token", http.StatusInternalServerError)
+		problem.Error(writer, "Failed to find organization", http.StatusInternalServerError)
 		return
 	}
 
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(http.StatusOK)
-	json.NewEncoder(writer).Encode(map[string]string{
+	tokenStr, err := h.signAccessToken(u.ID, orgID.UUID, mfa)
+	if err != nil {
+		problem.Error(writer, "Failed to sign token", http.StatusInternalServerError)
+		return
+	}
+
+	h.recordAttempt(request, username, u, auth.ReasonSuccess)
+
+	response := map[string]string{
 		"token":   tokenStr,
 		"message": "Login successful",
-	})
+	}
+	if orgID.Valid {
+		response["org_id"] = orgID.UUID.String()
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(response)
+}
+
+// signAccessToken issues an access token for userID working in orgID, or in
+// no organization when orgID is uuid.Nil
+func (h *UserHandler) signAccessToken(userID, orgID uuid.UUID, mfa bool) (string, error) {
+	claims := jwt.MapClaims{
+		"user_id": userID.String(),
+		"typ":     middleware.TokenTypeAccess,
+		"mfa":     mfa,
+	}
+	if orgID != uuid.Nil {
+		claims["org"] = orgID.String()
+	}
+	return h.JWT.Sign(claims, h.JWT.AccessTTL())
+}
+
+// parseUserID reads the {id} path segment
+func parseUserID(writer http.ResponseWriter, request *http.Request) (uuid.UUID, bool) {
+	id, err := uuid.Parse(request.PathValue("id"))
+	if err != nil {
+		problem.Error(writer, "Invalid id format", http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// isSelfOrAdmin reports whether the caller is the user id or an admin
+func isSelfOrAdmin(request *http.Request, id uuid.UUID) bool {
+	role, _ := request.Context().Value(middleware.RoleKey).(string)
+	userID, _ := request.Context().Value(middleware.UserIDKey).(string)
+	return role == user.RoleAdmin || userID == id.String()
+}
+
+func (h *UserHandler) writeUser(ctx context.Context, writer http.ResponseWriter, id uuid.UUID) {
+	u, err := h.Repo.FindByID(ctx, id)
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to find user", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(u)
+}
+
+// ListUsers lists all accounts
+func (h *UserHandler) ListUsers(writer http.ResponseWriter, request *http.Request) {
+	users, err := h.Repo.List(request.Context())
+	if err != nil {
+		problem.Error(writer, "Failed to list users", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(users)
+}
+
+// GetUser returns one account; users can only see their own
+func (h *UserHandler) GetUser(writer http.ResponseWriter, request *http.Request) {
+	id, ok := parseUserID(writer, request)
+	if !ok {
+		return
+	}
+
+	if !isSelfOrAdmin(request, id) {
+		problem.Error(writer, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	h.writeUser(request.Context(), writer, id)
+}
+
+// Me returns the account of the caller
+func (h *UserHandler) Me(writer http.ResponseWriter, request *http.Request) {
+	userID, _ := request.Context().Value(middleware.UserIDKey).(string)
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		problem.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h.writeUser(request.Context(), writer, id)
+}
+
+// userPatch holds the account fields a merge patch may change
+type userPatch struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// UpdateUser applies a JSON merge patch to an account. Users can edit their
+// own name and email; only admins can edit other accounts or roles.
+func (h *UserHandler) UpdateUser(writer http.ResponseWriter, request *http.Request) {
+	id, ok := parseUserID(writer, request)
+	if !ok {
+		return
+	}
+
+	if !isSelfOrAdmin(request, id) {
+		problem.Error(writer, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	patch, err := io.ReadAll(request.Body)
+	if err != nil {
+		problem.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	current, err := h.Repo.FindByID(request.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to find user", http.StatusInternalServerError)
+		return
+	}
+
+	fields := userPatch{Name: current.Name, Email: current.Email, Role: current.Role}
+	if err := applyMergePatch(&fields, patch); err != nil {
+		problem.Error(writer, "Invalid merge patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fields.Name = strings.TrimSpace(fields.Name)
+	fields.Email = strings.ToLower(strings.TrimSpace(fields.Email))
+	invalid := make(map[string]string)
+	if fields.Name == "" {
+		invalid["name"] = "is required"
+	}
+	if fields.Email != current.Email {
+		if msg := user.ValidateEmail(fields.Email); msg != "" {
+			invalid["email"] = msg
+		}
+	}
+	if len(invalid) > 0 {
+		writeFieldErrors(writer, http.StatusBadRequest, "Validation failed", invalid)
+		return
+	}
+
+	if fields.Role != current.Role {
+		if role, _ := request.Context().Value(middleware.RoleKey).(string); role != user.RoleAdmin {
+			problem.Error(writer, "Only admins can change roles", http.StatusForbidden)
+			return
+		}
+		if fields.Role != user.RoleUser && fields.Role != user.RoleAdmin {
+			problem.Error(writer, "Invalid role", http.StatusBadRequest)
+			return
+		}
+	}
+
+	emailChanged := fields.Email != current.Email
+	current.Name, current.Email, current.Role = fields.Name, fields.Email, fields.Role
+	err = h.Repo.Update(request.Context(), *current, middleware.Actor(request.Context()))
+	if writeUniqueViolation(writer, err) {
+		return
+	} else if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	if emailChanged {
+		h.sendVerification(request.Context(), id, current.Name, current.Email)
+	}
+
+	h.writeUser(request.Context(), writer, id)
+}
+
+func (h *UserHandler) setDisabled(writer http.ResponseWriter, request *http.Request, disabled bool) {
+	id, ok := parseUserID(writer, request)
+	if !ok {
+		return
+	}
+
+	if userID, _ := request.Context().Value(middleware.UserIDKey).(string); disabled && userID == id.String() {
+		problem.Error(writer, "You cannot disable your own account", http.StatusBadRequest)
+		return
+	}
+
+	err := h.Repo.SetDisabled(request.Context(), id, disabled, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeUser(request.Context(), writer, id)
+}
+
+// DisableUser blocks an account from signing in and using existing tokens
+func (h *UserHandler) DisableUser(writer http.ResponseWriter, request *http.Request) {
+	h.setDisabled(writer, request, true)
+}
+
+// EnableUser re-enables a disabled account
+func (h *UserHandler) EnableUser(writer http.ResponseWriter, request *http.Request) {
+	h.setDisabled(writer, request, false)
+}
+
+// UnlockUser clears the failed login counter and lockout of an account
+func (h *UserHandler) UnlockUser(writer http.ResponseWriter, request *http.Request) {
+	id, ok := parseUserID(writer, request)
+	if !ok {
+		return
+	}
+
+	err := h.Repo.Unlock(request.Context(), id, middleware.Actor(request.Context()))
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to unlock user", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeUser(request.Context(), writer, id)
+}
+
+// ListAuthAttempts returns the latest login attempts, optionally filtered
+// by ?username= and ?ip=
+func (h *UserHandler) ListAuthAttempts(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+
+	limit := 100
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			problem.Error(writer, "Limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	attempts, err := h.Attempts.List(request.Context(), query.Get("username"), query.Get("ip"), limit)
+	if err != nil {
+		problem.Error(writer, "Failed to list auth attempts", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(attempts)
 }
@@ -0,0 +1,279 @@
+// Package jwtauth signs and verifies the service's JWTs with asymmetric
+// keys (RS256 or EdDSA), identified by the "kid" header so that several
+// keys can be trusted at once while the signing key is rotated.
+package jwtauth
+
+import (
+	"auth-register-sistem/internal/config"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Leeway tolerates clock differences between us and other verifiers
+const Leeway = 30 * time.Second
+
+type key struct {
+	method jwt.SigningMethod
+	public crypto.PublicKey
+}
+
+// Manager signs tokens with the active key and verifies them with any
+// trusted key.
+type Manager struct {
+	cfg        config.JWTConfig
+	signingKID string
+	signingKey crypto.Signer
+	keys       map[string]key
+}
+
+// New loads the keys of cfg. Every *.pem file in the keys directory is a
+// key named after the file: private keys can sign and verify, public keys
+// (kept after a key is retired) can only verify. Without a keys directory
+// it generates a throwaway Ed25519 key when cfg.AllowEphemeralKey is set,
+// which is only suitable for development since tokens stop verifying on
+// restart.
+func New(cfg *config.JWTConfig) (*Manager, error) {
+	m := &Manager{cfg: *cfg, keys: make(map[string]key)}
+
+	if cfg.KeysDir == "" {
+		if !cfg.AllowEphemeralKey {
+			return nil, errors.New("no keys directory configured")
+		}
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		log.Println("JWT_KEYS_DIR is not set, signing tokens with a temporary development key")
+		m.signingKID = "ephemeral"
+		m.signingKey = private
+		m.keys[m.signingKID] = key{method: jwt.SigningMethodEdDSA, public: private.Public()}
+		return m, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(cfg.KeysDir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %w", err)
+	}
+
+	signers := make(map[string]crypto.Signer)
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		kid = strings.TrimSuffix(kid, ".pub")
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %w", kid, err)
+		}
+		signer, k, err := parseKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", kid, err)
+		}
+		if _, dup := m.keys[kid]; dup && signer == nil {
+			// Keep the private key when both halves are present
+			continue
+		}
+		m.keys[kid] = k
+		if signer != nil {
+			signers[kid] = signer
+		}
+	}
+
+	if cfg.SigningKID == "" {
+		return nil, errors.New("JWT_SIGNING_KID is required with JWT_KEYS_DIR")
+	}
+	signer, ok := signers[cfg.SigningKID]
+	if !ok {
+		return nil, fmt.Errorf("no private key for signing key %q in %s", cfg.SigningKID, cfg.KeysDir)
+	}
+	m.signingKID, m.signingKey = cfg.SigningKID, signer
+	return m, nil
+}
+
+// parseKey reads a PKCS#8 private key or a PKIX public key in PEM form.
+// The signer is nil for public keys.
+func parseKey(data []byte) (crypto.Signer, key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, key{}, errors.New("no PEM block found")
+	}
+
+	var public crypto.PublicKey
+	var signer crypto.Signer
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, key{}, err
+		}
+		s, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, key{}, errors.New("unsupported private key")
+		}
+		signer, public = s, s.Public()
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, key{}, err
+		}
+		public = parsed
+	default:
+		return nil, key{}, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, key{}, errors.New("RSA keys must have at least 2048 bits")
+		}
+		return signer, key{method: jwt.SigningMethodRS256, public: pub}, nil
+	case ed25519.PublicKey:
+		return signer, key{method: jwt.SigningMethodEdDSA, public: pub}, nil
+	default:
+		return nil, key{}, errors.New("only RSA and Ed25519 keys are supported")
+	}
+}
+
+// AccessTTL is the lifetime of access tokens
+func (m *Manager) AccessTTL() time.Duration {
+	return m.cfg.AccessTTL
+}
+
+// Sign adds the standard claims to claims and signs them with the active
+// key. The token expires after ttl.
+func (m *Manager) Sign(claims jwt.MapClaims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims["iss"] = m.cfg.Issuer
+	claims["aud"] = m.cfg.Audience
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+
+	token := jwt.NewWithClaims(m.keys[m.signingKID].method, claims)
+	token.Header["kid"] = m.signingKID
+	return token.SignedString(m.signingKey)
+}
+
+// Parse verifies the signature of tokenStr with the key named by its kid
+// and checks exp, nbf, iat, iss and aud.
+func (m *Manager) Parse(tokenStr string) (jwt.MapClaims, error) {
+	methods := []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+	if m.cfg.LegacySecret != "" {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+
+	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			return []byte(m.cfg.LegacySecret), nil
+		}
+		kid, _ := token.Header["kid"].(string)
+		k, ok := m.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		if token.Method.Alg() != k.method.Alg() {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return k.public, nil
+	},
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(Leeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	// Legacy tokens predate the iss and aud claims
+	if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+		if iss, _ := claims.GetIssuer(); iss != m.cfg.Issuer {
+			return nil, jwt.ErrTokenInvalidIssuer
+		}
+		aud, _ := claims.GetAudience()
+		if !containsString(aud, m.cfg.Audience) {
+			return nil, jwt.ErrTokenInvalidAudience
+		}
+	}
+	return claims, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// JWK is a public key in RFC 7517 form
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns every trusted public key, sorted by kid
+func (m *Manager) JWKS() map[string][]JWK {
+	kids := make([]string, 0, len(m.keys))
+	for kid := range m.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	keys := make([]JWK, 0, len(kids))
+	for _, kid := range kids {
+		k := m.keys[kid]
+		jwk := JWK{Kid: kid, Use: "sig", Alg: k.method.Alg()}
+		switch pub := k.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64URL(pub.N.Bytes())
+			jwk.E = base64URL(bigEndian(pub.E))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64URL(pub)
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string][]JWK{"keys": keys}
+}
+
+func base64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// bigEndian encodes a positive int in the minimal number of bytes
+func bigEndian(n int) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
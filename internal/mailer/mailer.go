@@ -0,0 +1,218 @@
+package mailer
+
+import (
+	"auth-register-sistem/internal/config"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends plain-text emails.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// New returns the mailer selected by cfg.Driver.
+func New(cfg *config.MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		if cfg.SMTPHost == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for the smtp mail driver")
+		}
+		return NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.From), nil
+	case "log":
+		return NewLogMailer(cfg.LogFile, cfg.From)
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+	}
+}
+
+// headerSafe strips line breaks so values cannot inject extra headers.
+func headerSafe(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+func message(from, to, subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", headerSafe(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerSafe(to))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerSafe(subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// SMTPMailer delivers mail through an SMTP relay, authenticating with PLAIN
+// auth when a username is set.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{addr: net.JoinHostPort(host, port), from: from}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// smtpTimeout bounds a whole delivery, from dialing the relay to QUIT, so a
+// stalled relay cannot hold a sender forever
+const smtpTimeout = 30 * time.Second
+
+// Send delivers one message the way smtp.SendMail does, upgrading to TLS
+// when the relay offers it, but under smtpTimeout.
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if err := m.send(to, message(m.from, to, subject, body)); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
+
+func (m *SMTPMailer) send(to string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", m.addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	host, _, _ := net.SplitHostPort(m.addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if err := c.Auth(m.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Queue sends mail from a background worker, so a request never waits on
+// delivery and its response time does not depend on whether a message was
+// sent. At most size messages wait; Send fails when the queue is full.
+type Queue struct {
+	next    Mailer
+	mu      sync.Mutex
+	closed  bool
+	pending chan queuedMail
+	done    chan struct{}
+}
+
+type queuedMail struct {
+	to, subject, body string
+}
+
+func NewQueue(next Mailer, size int) *Queue {
+	q := &Queue{next: next, pending: make(chan queuedMail, size), done: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+	for mail := range q.pending {
+		if err := q.next.Send(mail.to, mail.subject, mail.body); err != nil {
+			log.Println("Failed to send email:", err)
+		}
+	}
+}
+
+// Send queues a message; delivery errors are only logged
+func (q *Queue) Send(to, subject, body string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return fmt.Errorf("mail queue is closed")
+	}
+	select {
+	case q.pending <- queuedMail{to: to, subject: subject, body: body}:
+		return nil
+	default:
+		return fmt.Errorf("mail queue is full")
+	}
+}
+
+// Close stops accepting messages and waits until the queued ones are sent
+// or ctx is done.
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.pending)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d emails left unsent: %w", len(q.pending), ctx.Err())
+	}
+}
+
+// LogMailer writes messages to a file, or to the server log, instead of
+// delivering them. It is meant for local development.
+type LogMailer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+}
+
+func NewLogMailer(path, from string) (*LogMailer, error) {
+	if path == "" {
+		return &LogMailer{w: log.Writer(), from: from}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mail log: %w", err)
+	}
+	return &LogMailer{w: f, from: from}, nil
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := fmt.Fprintf(m.w, "%s\r\n\r\n", message(m.from, to, subject, body)); err != nil {
+		return fmt.Errorf("failed to write mail: %w", err)
+	}
+	return nil
+}
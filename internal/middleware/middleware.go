@@ -1,64 +1,250 @@
 package middleware
 
 import (
+	"auth-register-sistem/internal/jwtauth"
+	"auth-register-sistem/internal/model/apikey"
+	"auth-register-sistem/internal/model/org"
+	"auth-register-sistem/internal/model/user"
+	"auth-register-sistem/internal/problem"
+	"auth-register-sistem/internal/repository"
 	"context"
+	"errors"
 	"net/http"
-	"os"
 	"strings"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 type contextKey string
 
-const UserIDKey contextKey = "user_id"
+const (
+	UserIDKey contextKey = "user_id"
+	RoleKey   contextKey = "role"
+	// MFAKey is true when the token was issued after a second factor
+	MFAKey contextKey = "mfa"
+	// ServiceKey holds the *apikey.APIKey of requests authenticated with an
+	// API key; those requests have no UserIDKey
+	ServiceKey contextKey = "service"
+	// OrgIDKey holds the uuid.UUID of the organization the request works
+	// in, and OrgRoleKey the caller's role in it. Services have no role.
+	OrgIDKey   contextKey = "org_id"
+	OrgRoleKey contextKey = "org_role"
+)
+
+// Values of the "typ" claim. Tokens issued before the claim existed have
+// none and are treated as access tokens.
+const (
+	TokenTypeAccess       = "access"
+	TokenTypeMFAChallenge = "mfa_challenge"
+)
+
+// Authenticator validates bearer tokens and checks that the account behind
+// them still exists and is enabled, and that it is still a member of the
+// organization in the token. It also accepts API keys, either as the bearer
+// token or in the X-API-Key header.
+type Authenticator struct {
+	Users  repository.UserRepository
+	Keys   repository.APIKeyRepository
+	Orgs   repository.OrgRepository
+	Tokens *jwtauth.Manager
+}
+
+func NewAuthenticator(users repository.UserRepository, keys repository.APIKeyRepository, orgs repository.OrgRepository, tokens *jwtauth.Manager) *Authenticator {
+	return &Authenticator{Users: users, Keys: keys, Orgs: orgs, Tokens: tokens}
+}
+
+// authenticateKey puts the service identity of an API key in the context
+func (a *Authenticator) authenticateKey(writer http.ResponseWriter, request *http.Request, key string, next http.HandlerFunc) {
+	service, err := a.Keys.Authenticate(request.Context(), key)
+	if errors.Is(err, repository.ErrNotFound) {
+		problem.Error(writer, "Invalid API key", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		problem.Error(writer, "Failed to check API key", http.StatusInternalServerError)
+		return
+	}
 
-func Auth(next http.HandlerFunc) http.HandlerFunc {
+	ctx := context.WithValue(request.Context(), ServiceKey, service)
+	ctx = context.WithValue(ctx, OrgIDKey, service.OrgID)
+	next.ServeHTTP(writer, request.WithContext(ctx))
+}
+
+func (a *Authenticator) Auth(next http.HandlerFunc) http.HandlerFunc {
 	return func(writer http.ResponseWriter, response *http.Request) {
+		if key := response.Header.Get("X-API-Key"); key != "" {
+			a.authenticateKey(writer, response, key, next)
+			return
+		}
+
 		authHeader := response.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(writer, "Missing Authorization header", http.StatusUnauthorized)
+			problem.Error(writer, "Missing Authorization header", http.StatusUnauthorized)
 			return
 		}
 
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(writer, "Invalid Authorization header", http.StatusUnauthorized)
+			problem.Error(writer, "Invalid Authorization header", http.StatusUnauthorized)
 			return
 		}
 
 		tokenStr := parts[1]
-		secret := os.Getenv("JWT_SECRET")
-		if secret == "" {
-			http.Error(writer, "Missing JWT_SECRET environment variable", http.StatusInternalServerError)
+		if strings.HasPrefix(tokenStr, apikey.Prefix) {
+			a.authenticateKey(writer, response, tokenStr, next)
 			return
 		}
 
-		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return []byte(secret), nil
-		})
+		claims, err := a.Tokens.Parse(tokenStr)
+		if err != nil {
+			problem.Error(writer, "Invalid token", http.StatusUnauthorized)
+			return
+		}
 
-		if err != nil || !token.Valid {
-			http.Error(writer, "Invalid token", http.StatusUnauthorized)
+		if claims["user_id"] == nil {
+			problem.Error(writer, "Invalid token claims", http.StatusUnauthorized)
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || claims["user_id"] == nil {
-			http.Error(writer, "Invalid token claims", http.StatusUnauthorized)
+		if typ, ok := claims["typ"]; ok && typ != TokenTypeAccess {
+			problem.Error(writer, "Invalid token type", http.StatusUnauthorized)
 			return
 		}
 
 		userId, ok := claims["user_id"].(string)
 		if !ok {
-			http.Error(writer, "Invalid token claims", http.StatusUnauthorized)
+			problem.Error(writer, "Invalid token claims", http.StatusUnauthorized)
+			return
+		}
+
+		id, err := uuid.Parse(userId)
+		if err != nil {
+			problem.Error(writer, "Invalid token claims", http.StatusUnauthorized)
+			return
+		}
+
+		// Tokens stay valid until they expire, so the account status is
+		// checked on every request
+		account, err := a.Users.FindByID(response.Context(), id)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			problem.Error(writer, "Failed to find user", http.StatusInternalServerError)
+			return
+		}
+		if account == nil || account.DisabledAt != nil {
+			problem.Error(writer, "Account not found or disabled", http.StatusUnauthorized)
 			return
 		}
 
 		ctx := context.WithValue(response.Context(), UserIDKey, userId)
+		ctx = context.WithValue(ctx, RoleKey, account.Role)
+		mfa, _ := claims["mfa"].(bool)
+		ctx = context.WithValue(ctx, MFAKey, mfa)
+
+		// A user removed from the organization keeps their token but works
+		// as if no organization was selected
+		if orgClaim, _ := claims["org"].(string); orgClaim != "" {
+			orgID, err := uuid.Parse(orgClaim)
+			if err != nil {
+				problem.Error(writer, "Invalid token claims", http.StatusUnauthorized)
+				return
+			}
+			role, err := a.Orgs.GetRole(ctx, orgID, id)
+			if err != nil && !errors.Is(err, repository.ErrNotFound) {
+				problem.Error(writer, "Failed to find organization membership", http.StatusInternalServerError)
+				return
+			}
+			if err == nil {
+				ctx = context.WithValue(ctx, OrgIDKey, orgID)
+				ctx = context.WithValue(ctx, OrgRoleKey, role)
+			}
+		}
 		next.ServeHTTP(writer, response.WithContext(ctx))
 	}
 }
+
+// RequireAdmin only lets admins through. It must be wrapped by Auth.
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if role, _ := request.Context().Value(RoleKey).(string); role != user.RoleAdmin {
+			problem.Error(writer, "Admin role required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	}
+}
+
+// ActorID returns the user behind the request, or a null id for services
+func ActorID(ctx context.Context) uuid.NullUUID {
+	userID, _ := ctx.Value(UserIDKey).(string)
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return uuid.NullUUID{}
+	}
+	return uuid.NullUUID{UUID: id, Valid: true}
+}
+
+// OrgID returns the organization the request works in, or uuid.Nil when
+// none was selected
+func OrgID(ctx context.Context) uuid.UUID {
+	orgID, _ := ctx.Value(OrgIDKey).(uuid.UUID)
+	return orgID
+}
+
+// RequireOrg refuses requests without an organization. It must be wrapped
+// by Auth.
+func RequireOrg(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if OrgID(request.Context()) == uuid.Nil {
+			problem.ErrorCode(writer, "No organization selected, create or switch to one first", http.StatusForbidden, problem.CodeOrgRequired)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	}
+}
+
+// RequireOrgAdmin only lets through admins of the organization the request
+// works in. It must be wrapped by Auth.
+func RequireOrgAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if role, _ := request.Context().Value(OrgRoleKey).(string); role != org.RoleAdmin {
+			problem.Error(writer, "Organization admin role required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	}
+}
+
+// RequireUser refuses requests authenticated with an API key. It must be
+// wrapped by Auth.
+func RequireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if _, ok := request.Context().Value(ServiceKey).(*apikey.APIKey); ok {
+			problem.Error(writer, "This route is not available to API keys", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	}
+}
+
+// RequireScope checks that an API key was granted scope. Users are not
+// restricted by scopes. It must be wrapped by Auth.
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if service, ok := request.Context().Value(ServiceKey).(*apikey.APIKey); ok && !service.HasScope(scope) {
+			problem.ErrorCode(writer, "API key lacks the "+scope+" scope", http.StatusForbidden, problem.CodeInsufficientScope)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	}
+}
+
+// RequireMFA only lets through tokens issued after a second factor. It must
+// be wrapped by Auth.
+func RequireMFA(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if mfa, _ := request.Context().Value(MFAKey).(bool); !mfa {
+			problem.ErrorCode(writer, "This action requires signing in with MFA", http.StatusForbidden, problem.CodeMFARequired)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	}
+}
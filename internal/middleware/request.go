@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"auth-register-sistem/internal/model/apikey"
+	"auth-register-sistem/internal/model/audit"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// RequestIDKey holds the ID of the request, also sent back in the
+	// X-Request-ID header
+	RequestIDKey contextKey = "request_id"
+	// ClientIPKey holds the address of the caller
+	ClientIPKey contextKey = "client_ip"
+)
+
+// requestIDPattern limits the request IDs accepted from callers, since they
+// end up in logs and the audit log
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ClientIP returns the address of the caller, trusting X-Forwarded-For only
+// when the server runs behind a proxy. Only the rightmost entry, the one
+// that proxy appended, is used: the entries before it come from the caller
+// and can be forged.
+func ClientIP(request *http.Request, trustProxy bool) string {
+	if values := request.Header.Values("X-Forwarded-For"); trustProxy && len(values) > 0 {
+		entries := strings.Split(values[len(values)-1], ",")
+		if last := strings.TrimSpace(entries[len(entries)-1]); last != "" {
+			return last
+		}
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// RequestID tags every request with an ID, reusing the caller's
+// X-Request-ID when it is well formed, and records the client IP.
+func RequestID(trustProxy bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		writer.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(request.Context(), RequestIDKey, id)
+		ctx = context.WithValue(ctx, ClientIPKey, ClientIP(request, trustProxy))
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// Deadline bounds the time spent on each request: once timeout passes, the
+// request context is cancelled and so are its database queries. A zero
+// timeout leaves requests unbounded.
+func Deadline(timeout time.Duration, next http.Handler) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx, cancel := context.WithTimeout(request.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// Actor describes who is behind the request for the audit log
+func Actor(ctx context.Context) audit.Actor {
+	actor := audit.Actor{UserID: ActorID(ctx)}
+	if service, ok := ctx.Value(ServiceKey).(*apikey.APIKey); ok {
+		actor.APIKeyID = uuid.NullUUID{UUID: service.ID, Valid: true}
+	}
+	actor.RequestID, _ = ctx.Value(RequestIDKey).(string)
+	actor.IP, _ = ctx.Value(ClientIPKey).(string)
+	return actor
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarded  []string
+		trustProxy bool
+		want       string
+	}{
+		{"no proxy", nil, false, "10.0.0.1"},
+		{"header ignored without proxy", []string{"203.0.113.9"}, false, "10.0.0.1"},
+		{"proxy without header", nil, true, "10.0.0.1"},
+		{"proxy", []string{"203.0.113.9"}, true, "203.0.113.9"},
+		{"spoofed entry before the proxy's", []string{"198.51.100.66, 203.0.113.9"}, true, "203.0.113.9"},
+		{"spoofed header before the proxy's", []string{"198.51.100.66", "203.0.113.9"}, true, "203.0.113.9"},
+		{"spaces", []string{"198.51.100.66 ,  203.0.113.9 "}, true, "203.0.113.9"},
+		{"empty last entry", []string{"198.51.100.66,"}, true, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/", nil)
+			request.RemoteAddr = "10.0.0.1:51234"
+			for _, v := range tt.forwarded {
+				request.Header.Add("X-Forwarded-For", v)
+			}
+			if got := ClientIP(request, tt.trustProxy); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package apikey
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scopes an API key can be granted. Read scopes cover GET routes and write
+// scopes the routes that change data.
+const (
+	ScopeStockRead        = "stock:read"
+	ScopeStockWrite       = "stock:write"
+	ScopeTransactionRead  = "transaction:read"
+	ScopeTransactionWrite = "transaction:write"
+	ScopeReturnRead       = "return:read"
+	ScopeReturnWrite      = "return:write"
+	ScopeBOMRead          = "bom:read"
+	ScopeBOMWrite         = "bom:write"
+	ScopePriceListRead    = "price_list:read"
+	ScopePriceListWrite   = "price_list:write"
+	ScopeReportRead       = "report:read"
+)
+
+// Scopes lists every valid scope
+var Scopes = []string{
+	ScopeStockRead, ScopeStockWrite,
+	ScopeTransactionRead, ScopeTransactionWrite,
+	ScopeReturnRead, ScopeReturnWrite,
+	ScopeBOMRead, ScopeBOMWrite,
+	ScopePriceListRead, ScopePriceListWrite,
+	ScopeReportRead,
+}
+
+// Prefix starts every key so they are easy to spot in logs and configs
+const Prefix = "sk_"
+
+// APIKey is a credential for services, valid for the data of OrgID only.
+// The key itself is only shown once on creation; Prefix identifies it
+// afterwards.
+type APIKey struct {
+	ID         uuid.UUID     `json:"id"`
+	OrgID      uuid.UUID     `json:"org_id"`
+	Name       string        `json:"name"`
+	Prefix     string        `json:"prefix"`
+	Scopes     []string      `json:"scopes"`
+	CreatedBy  uuid.NullUUID `json:"created_by"`
+	CreatedAt  time.Time     `json:"created_at"`
+	LastUsedAt *time.Time    `json:"last_used_at"`
+	ExpiresAt  *time.Time    `json:"expires_at"`
+	RevokedAt  *time.Time    `json:"revoked_at"`
+}
+
+// HasScope reports whether the key was granted scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope reports whether scope is one of Scopes
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
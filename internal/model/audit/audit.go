@@ -0,0 +1,148 @@
+package audit
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionCreate        = "create"
+	ActionUpdate        = "update"
+	ActionDelete        = "delete"
+	ActionRestore       = "restore"
+	ActionArchive       = "archive"
+	ActionPurge         = "purge"
+	ActionSetUnits      = "set_units"
+	ActionDisable       = "disable"
+	ActionEnable        = "enable"
+	ActionUnlock        = "unlock"
+	ActionDisableMFA    = "disable_mfa"
+	ActionEnableMFA     = "enable_mfa"
+	ActionResetPassword = "reset_password"
+	ActionVerifyEmail   = "verify_email"
+	ActionRevoke        = "revoke"
+	ActionSetPrices     = "set_prices"
+)
+
+// Types of the entities changes are recorded for
+const (
+	EntityStock        = "stock"
+	EntityTransaction  = "transaction"
+	EntityUser         = "user"
+	EntityOrgMember    = "org_member"
+	EntityReturn       = "return"
+	EntityBOM          = "bom"
+	EntityKitOperation = "kit_operation"
+	EntityAPIKey       = "api_key"
+	EntityPriceList    = "price_list"
+)
+
+// Actor identifies who made a change and where the request came from.
+// Changes made with an API key have an APIKeyID and no UserID.
+type Actor struct {
+	UserID    uuid.NullUUID
+	APIKeyID  uuid.NullUUID
+	RequestID string
+	IP        string
+}
+
+// Entry is one change in the audit log. Before and After are JSON
+// snapshots of the entity, null when it did not exist; Changes holds the
+// fields that differ between them. Hash covers every other field and
+// PrevHash, the hash of the entry before it, so editing or removing an
+// entry breaks the chain.
+type Entry struct {
+	ID         int64             `json:"id"`
+	OrgID      uuid.NullUUID     `json:"org_id"`
+	ActorID    uuid.NullUUID     `json:"actor_id"`
+	APIKeyID   uuid.NullUUID     `json:"api_key_id"`
+	Action     string            `json:"action"`
+	EntityType string            `json:"entity_type"`
+	EntityID   string            `json:"entity_id"`
+	Before     json.RawMessage   `json:"before"`
+	After      json.RawMessage   `json:"after"`
+	Changes    map[string]Change `json:"changes"`
+	RequestID  string            `json:"request_id"`
+	IP         string            `json:"ip"`
+	CreatedAt  time.Time         `json:"created_at"`
+	PrevHash   string            `json:"prev_hash"`
+	Hash       string            `json:"hash"`
+}
+
+// Change is the value of a field before and after a change
+type Change struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// Filter selects audit entries. Zero fields match everything; BeforeID
+// pages backwards from an entry ID.
+type Filter struct {
+	OrgID      uuid.NullUUID
+	ActorID    uuid.NullUUID
+	EntityType string
+	EntityID   string
+	Action     string
+	From       sql.NullTime
+	To         sql.NullTime
+	BeforeID   int64
+	Limit      int
+}
+
+// Verification is the result of checking the hash chain. FirstInvalidID
+// is the first entry whose hash or link to the previous entry is wrong.
+type Verification struct {
+	Valid          bool  `json:"valid"`
+	Entries        int   `json:"entries"`
+	FirstInvalidID int64 `json:"first_invalid_id,omitempty"`
+}
+
+// Diff returns the top-level fields of two JSON objects whose values
+// differ. A missing object counts as having no fields.
+func Diff(before, after json.RawMessage) (map[string]Change, error) {
+	var oldFields, newFields map[string]json.RawMessage
+	if len(before) > 0 {
+		if err := json.Unmarshal(before, &oldFields); err != nil {
+			return nil, err
+		}
+	}
+	if len(after) > 0 {
+		if err := json.Unmarshal(after, &newFields); err != nil {
+			return nil, err
+		}
+	}
+
+	changes := make(map[string]Change)
+	for field, value := range oldFields {
+		if other, ok := newFields[field]; !ok || !equalJSON(value, other) {
+			changes[field] = Change{Before: value, After: nullIfMissing(other)}
+		}
+	}
+	for field, value := range newFields {
+		if _, ok := oldFields[field]; !ok {
+			changes[field] = Change{Before: json.RawMessage("null"), After: value}
+		}
+	}
+	return changes, nil
+}
+
+// equalJSON compares two JSON values, ignoring insignificant whitespace
+func equalJSON(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+func nullIfMissing(v json.RawMessage) json.RawMessage {
+	if v == nil {
+		return json.RawMessage("null")
+	}
+	return v
+}
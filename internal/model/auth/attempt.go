@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Outcomes of an authentication attempt
+const (
+	ReasonSuccess     = "success"
+	ReasonUnknownUser = "unknown_user"
+	ReasonBadPassword = "bad_password"
+	ReasonLocked      = "locked"
+	ReasonDisabled    = "disabled"
+	ReasonUnverified  = "unverified"
+	ReasonRateLimited = "rate_limited"
+	// ReasonMFAChallenge is a correct password on an account with MFA,
+	// answered with a challenge rather than a token
+	ReasonMFAChallenge = "mfa_challenge"
+	ReasonBadMFACode   = "bad_mfa_code"
+	// ReasonBadIDToken is a failed code exchange or ID token validation
+	// in an OpenID Connect login
+	ReasonBadIDToken = "bad_id_token"
+)
+
+// Attempt is one audited login attempt. Username is what the client sent;
+// UserID is only set when it matched an account.
+type Attempt struct {
+	ID        uuid.UUID     `json:"id"`
+	Username  string        `json:"username"`
+	UserID    uuid.NullUUID `json:"user_id"`
+	IP        string        `json:"ip"`
+	UserAgent string        `json:"user_agent"`
+	Success   bool          `json:"success"`
+	Reason    string        `json:"reason"`
+	CreatedAt time.Time     `json:"created_at"`
+}
@@ -0,0 +1,34 @@
+package bom
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+type OperationType string
+
+const (
+	TypeAssembly    OperationType = "ASSEMBLY"
+	TypeDisassembly OperationType = "DISASSEMBLY"
+)
+
+// Component is one line of a kit's bill of materials: Quantity units of
+// ComponentID are consumed to build a single kit.
+type Component struct {
+	KitID       uuid.UUID       `json:"kit_id"`
+	ComponentID uuid.UUID       `json:"component_id"`
+	Name        string          `json:"name"`
+	Quantity    decimal.Decimal `json:"quantity"`
+}
+
+// Operation is an assembly or disassembly run of Quantity kits.
+type Operation struct {
+	ID        uuid.UUID       `json:"id"`
+	KitID     uuid.UUID       `json:"kit_id"`
+	Type      OperationType   `json:"type"`
+	Quantity  decimal.Decimal `json:"quantity"`
+	CreatedAt time.Time       `json:"created_at"`
+	CreatedBy uuid.NullUUID   `json:"created_by"`
+}
@@ -0,0 +1,49 @@
+package org
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Roles a member can have in an organization. Admins manage members and
+// API keys; every member can work with the organization's data.
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,48}[a-z0-9]$`)
+
+// Organization is a tenant. Stock, ledger, returns, kits, price lists and
+// API keys all belong to exactly one organization. Role is the caller's
+// role when listing their own organizations.
+type Organization struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	Role      string    `json:"role,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Member is a user's membership of an organization
+type Member struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Username  string    `json:"username"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ValidRole reports whether role is a member role
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleMember
+}
+
+// ValidSlug reports whether slug is 3 to 50 lowercase letters, digits or
+// inner '-'
+func ValidSlug(slug string) bool {
+	return slugPattern.MatchString(slug)
+}
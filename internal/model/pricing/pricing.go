@@ -0,0 +1,34 @@
+package pricing
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// PriceList is a named set of product prices (e.g. "retail", "wholesale")
+// in one currency. A list applies while now is within [ValidFrom, ValidTo);
+// a missing bound is open.
+type PriceList struct {
+	ID        uuid.UUID     `json:"id"`
+	Name      string        `json:"name"`
+	Currency  string        `json:"currency"`
+	ValidFrom *time.Time    `json:"valid_from"`
+	ValidTo   *time.Time    `json:"valid_to"`
+	CreatedAt time.Time     `json:"created_at"`
+	CreatedBy uuid.NullUUID `json:"created_by"`
+}
+
+type Item struct {
+	ProductID uuid.UUID       `json:"product_id"`
+	Price     decimal.Decimal `json:"price"`
+}
+
+// Price is the price that applies to a product, either from a price list
+// or, when the product is not on the requested list, its sale price.
+type Price struct {
+	Amount      decimal.Decimal `json:"amount"`
+	Currency    string          `json:"currency"`
+	PriceListID uuid.NullUUID   `json:"price_list_id"`
+}
@@ -0,0 +1,24 @@
+package report
+
+import (
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// MarginLine summarizes sales of one product in one currency over a period.
+// Revenue comes from the unit prices of EXIT transactions, less the returns
+// of the period at the price they were sold for, and Cost from the weighted
+// average unit cost of ENTRY transactions in the same currency, falling
+// back to the product's cost price. Cost-derived fields are null when no
+// cost is known.
+type MarginLine struct {
+	ProductID     uuid.NullUUID       `json:"product_id"`
+	Name          string              `json:"name"`
+	Currency      string              `json:"currency"`
+	QuantitySold  decimal.Decimal     `json:"quantity_sold"`
+	Revenue       decimal.Decimal     `json:"revenue"`
+	AverageCost   decimal.NullDecimal `json:"average_cost"`
+	Cost          decimal.NullDecimal `json:"cost"`
+	Margin        decimal.NullDecimal `json:"margin"`
+	MarginPercent decimal.NullDecimal `json:"margin_percent"`
+}
@@ -0,0 +1,25 @@
+package rma
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Return records goods received back against an outbound EXIT transaction.
+// The received quantity is split by inspection outcome: only the restocked
+// portion goes back into available stock, quarantined units are held apart
+// and scrapped units are written off.
+type Return struct {
+	ID            uuid.UUID       `json:"id"`
+	TransactionID uuid.UUID       `json:"transaction_id"`
+	Name          string          `json:"name"`
+	Quantity      decimal.Decimal `json:"quantity"`
+	Restocked     decimal.Decimal `json:"restocked"`
+	Scrapped      decimal.Decimal `json:"scrapped"`
+	Quarantined   decimal.Decimal `json:"quarantined"`
+	Reason        string          `json:"reason"`
+	CreatedAt     time.Time       `json:"created_at"`
+	CreatedBy     uuid.NullUUID   `json:"created_by"`
+}
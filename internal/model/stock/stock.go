@@ -1,15 +1,76 @@
 package stock
 
 import (
-	"github.com/google/uuid"
+	"auth-register-sistem/internal/model/pricing"
+	"encoding/json"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
 )
 
+// MaxPrecision is the largest number of decimal places a product quantity
+// may have; it matches the scale of the quantity columns.
+const MaxPrecision = 6
+
+// MaxVariants caps the combinations a single request may generate
+const MaxVariants = 500
+
+// Stock is a product. A product with ParentID set is a variant of that
+// parent (e.g. one size/color combination) and holds its own quantity; the
+// parent aggregates the quantities of its variants.
+//
+// Precision is the number of decimal places allowed in quantities of this
+// product: 0 for products counted in whole units, 3 for grams of a product
+// stocked in kg, and so on.
+//
+// Version is incremented on every change to the row and is used as the
+// product's ETag for optimistic concurrency control. UpdatedBy is the user
+// behind the latest version, null for changes made with an API key.
+//
+// DeletedAt is set on soft-deleted products; ArchivedAt additionally marks
+// a deleted product whose ledger history may be detached by purging it.
 type Stock struct {
-	ID        uuid.UUID `json:"id"`
-	Name      string    `json:"name"`
-	Quantity  int       `json:"quantity"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	CreatedBy uuid.UUID `json:"created_by"`
+	ID                  uuid.UUID           `json:"id"`
+	Name                string              `json:"name"`
+	SKU                 string              `json:"sku"`
+	ParentID            uuid.NullUUID       `json:"parent_id"`
+	Attributes          map[string]string   `json:"attributes,omitempty"`
+	BaseUnit            string              `json:"base_unit"`
+	Precision           int                 `json:"precision"`
+	Quantity            decimal.Decimal     `json:"quantity"`
+	QuarantinedQuantity decimal.Decimal     `json:"quarantined_quantity"`
+	Currency            string              `json:"currency"`
+	SalePrice           decimal.NullDecimal `json:"sale_price"`
+	CostPrice           decimal.NullDecimal `json:"cost_price"`
+	Price               *pricing.Price      `json:"price,omitempty"`
+	CreatedAt           time.Time           `json:"created_at"`
+	UpdatedAt           time.Time           `json:"updated_at"`
+	CreatedBy           uuid.NullUUID       `json:"created_by"`
+	UpdatedBy           uuid.NullUUID       `json:"updated_by"`
+	Version             int                 `json:"version"`
+	DeletedAt           *time.Time          `json:"deleted_at,omitempty"`
+	ArchivedAt          *time.Time          `json:"archived_at,omitempty"`
+	Variants            []Stock             `json:"variants,omitempty"`
+}
+
+// Revision is one version of a product: a replaced one from its history or
+// the current one. Product is the stored row as it was at that version.
+type Revision struct {
+	Version   int             `json:"version"`
+	UpdatedBy uuid.NullUUID   `json:"updated_by"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Product   json.RawMessage `json:"product"`
+}
+
+// Unit is an alternative unit of measure for a product, worth Factor base
+// units (e.g. a "box" of 12).
+type Unit struct {
+	Name   string          `json:"name"`
+	Factor decimal.Decimal `json:"factor"`
+}
+
+// FitsPrecision reports whether q has no more than precision decimal places.
+func FitsPrecision(q decimal.Decimal, precision int) bool {
+	return q.Equal(q.Truncate(int32(precision)))
 }
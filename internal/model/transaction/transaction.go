@@ -1,23 +1,34 @@
 package transaction
 
 import (
-	"github.com/google/uuid"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
 )
 
 type TransactionType string
 
 const (
-	TypeIn  TransactionType = "ENTRY"
-	TypeOut TransactionType = "EXIT"
+	TypeIn     TransactionType = "ENTRY"
+	TypeOut    TransactionType = "EXIT"
+	TypeReturn TransactionType = "RETURN"
 )
 
+// Transaction is a ledger entry. Quantity is always in the product's base
+// unit; Unit and UnitQuantity keep the unit and amount originally entered.
+// UnitPrice is per base unit: the purchase cost on ENTRY and the sale price
+// on EXIT.
 type Transaction struct {
-	ID        uuid.UUID       `json:"id"`
-	Name      string          `json:"name"`
-	Quantity  int             `json:"quantity"`
-	Type      TransactionType `json:"type"`
-	CreatedAt time.Time       `json:"created_at"`
-	UpdatedAt time.Time       `json:"updated_at"`
-	CreatedBy uuid.UUID       `json:"created_by"`
+	ID           uuid.UUID           `json:"id"`
+	Name         string              `json:"name"`
+	Quantity     decimal.Decimal     `json:"quantity"`
+	Unit         string              `json:"unit"`
+	UnitQuantity decimal.Decimal     `json:"unit_quantity"`
+	UnitPrice    decimal.NullDecimal `json:"unit_price"`
+	Type         TransactionType     `json:"type"`
+	ReferenceID  uuid.NullUUID       `json:"reference_id"`
+	CreatedAt    time.Time           `json:"created_at"`
+	UpdatedAt    time.Time           `json:"updated_at"`
+	CreatedBy    uuid.NullUUID       `json:"created_by"`
 }
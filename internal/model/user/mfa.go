@@ -0,0 +1,14 @@
+package user
+
+import "time"
+
+// MFA is the TOTP state of an account. Secret is set on enrollment and
+// only takes effect once EnabledAt is set by a verified code.
+type MFA struct {
+	Secret      string
+	EnabledAt   *time.Time
+	LastCounter int64
+}
+
+// RecoveryCodeCount is how many one-time recovery codes an account gets
+const RecoveryCodeCount = 10
@@ -0,0 +1,61 @@
+package user
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,50}$`)
+
+// RegisterRequest is the body accepted by the registration endpoint.
+type RegisterRequest struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// Normalize trims surrounding whitespace and lowercases the email.
+func (r *RegisterRequest) Normalize() {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Username = strings.TrimSpace(r.Username)
+	r.Email = strings.ToLower(strings.TrimSpace(r.Email))
+	r.Password = strings.TrimSpace(r.Password)
+}
+
+// Validate returns a message per invalid field; the password policy is
+// checked separately since it depends on configuration.
+func (r RegisterRequest) Validate() map[string]string {
+	errs := make(map[string]string)
+	if r.Name == "" {
+		errs["name"] = "is required"
+	} else if len(r.Name) > 200 {
+		errs["name"] = "must be at most 200 characters long"
+	}
+	if !usernamePattern.MatchString(r.Username) {
+		errs["username"] = "must be 3 to 50 letters, digits, '_', '.' or '-'"
+	}
+	if msg := ValidateEmail(r.Email); msg != "" {
+		errs["email"] = msg
+	}
+	if r.Password == "" {
+		errs["password"] = "is required"
+	}
+	return errs
+}
+
+// ValidateEmail returns why email is not a plain address, or "" if it is.
+func ValidateEmail(email string) string {
+	if email == "" {
+		return "is required"
+	}
+	if len(email) > 100 {
+		return "must be at most 100 characters long"
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "is not a valid email address"
+	}
+	return ""
+}
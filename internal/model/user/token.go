@@ -0,0 +1,7 @@
+package user
+
+// Purposes of single-use account tokens
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+)
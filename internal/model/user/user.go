@@ -5,12 +5,30 @@ import (
 	"time"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// User is an account. Password holds the bcrypt hash and is never
+// serialized; DisabledAt is set on accounts that may no longer sign in and
+// EmailVerifiedAt once the owner proved they read the email address.
+// FailedLogins counts consecutive failed logins; Locked is true while
+// LockedUntil is in the future. MFAEnabledAt is set while TOTP is required
+// at login.
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	Name      string    `json:"name"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID              uuid.UUID  `json:"id"`
+	Name            string     `json:"name"`
+	Username        string     `json:"username"`
+	Email           string     `json:"email"`
+	Password        string     `json:"-"`
+	Role            string     `json:"role"`
+	DisabledAt      *time.Time `json:"disabled_at"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	FailedLogins    int        `json:"failed_logins"`
+	LockedUntil     *time.Time `json:"locked_until"`
+	Locked          bool       `json:"locked"`
+	MFAEnabledAt    *time.Time `json:"mfa_enabled_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
 }
@@ -0,0 +1,88 @@
+package password
+
+import (
+	"auth-register-sistem/internal/config"
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Policy checks new passwords against length, character class and
+// breached-password rules.
+type Policy struct {
+	cfg      config.PasswordConfig
+	breached map[string]struct{}
+}
+
+// NewPolicy builds a policy from cfg, loading the breached-password list
+// if one is configured.
+func NewPolicy(cfg *config.PasswordConfig) (*Policy, error) {
+	p := &Policy{cfg: *cfg, breached: make(map[string]struct{})}
+	if cfg.BreachedList == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(cfg.BreachedList)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password list: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.breached[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read breached password list: %w", err)
+	}
+	return p, nil
+}
+
+// MaxBytes is the longest password bcrypt accepts
+const MaxBytes = 72
+
+// Validate returns the rules pw breaks, or nil if it is acceptable.
+func (p *Policy) Validate(pw string) []string {
+	var problems []string
+	if len([]rune(pw)) < p.cfg.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.cfg.MinLength))
+	}
+	if len(pw) > MaxBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes long", MaxBytes))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range pw {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+	if p.cfg.RequireUpper && !upper {
+		problems = append(problems, "must contain an uppercase letter")
+	}
+	if p.cfg.RequireLower && !lower {
+		problems = append(problems, "must contain a lowercase letter")
+	}
+	if p.cfg.RequireDigit && !digit {
+		problems = append(problems, "must contain a digit")
+	}
+	if p.cfg.RequireSymbol && !symbol {
+		problems = append(problems, "must contain a symbol")
+	}
+
+	if _, ok := p.breached[strings.ToLower(pw)]; ok {
+		problems = append(problems, "appears in a list of breached passwords")
+	}
+	return problems
+}
@@ -0,0 +1,76 @@
+package password
+
+import (
+	"auth-register-sistem/internal/config"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(list, []byte("Password1\n\n  Summer2024  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	strict := config.PasswordConfig{
+		MinLength:     8,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+		BreachedList:  list,
+	}
+	lenient := config.PasswordConfig{MinLength: 1}
+
+	tests := []struct {
+		name string
+		cfg  config.PasswordConfig
+		pw   string
+		want []string
+	}{
+		{"acceptable", strict, "Correct-Horse1", nil},
+		{"too short", strict, "Ab1!", []string{"must be at least 8 characters long"}},
+		{"length counts characters", strict, "Äb1!çãõé", nil},
+		{"no uppercase", strict, "correct-horse1", []string{"must contain an uppercase letter"}},
+		{"no lowercase", strict, "CORRECT-HORSE1", []string{"must contain a lowercase letter"}},
+		{"no digit", strict, "Correct-Horse", []string{"must contain a digit"}},
+		{"no symbol", strict, "CorrectHorse1", []string{"must contain a symbol"}},
+		{"breached", lenient, "password1", []string{"appears in a list of breached passwords"}},
+		{"breached after trimming", lenient, "summer2024", []string{"appears in a list of breached passwords"}},
+		{"at bcrypt limit", lenient, strings.Repeat("a", MaxBytes), nil},
+		{"over bcrypt limit", lenient, strings.Repeat("a", MaxBytes+1), []string{"must be at most 72 bytes long"}},
+		{"limit counts bytes", lenient, strings.Repeat("é", MaxBytes/2+1), []string{"must be at most 72 bytes long"}},
+		{"every rule", strict, "", []string{
+			"must be at least 8 characters long",
+			"must contain an uppercase letter",
+			"must contain a lowercase letter",
+			"must contain a digit",
+			"must contain a symbol",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			if cfg.BreachedList == "" {
+				cfg.BreachedList = list
+			}
+			p, err := NewPolicy(&cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Validate(tt.pw); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate(%q) = %q, want %q", tt.pw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPolicyMissingList(t *testing.T) {
+	_, err := NewPolicy(&config.PasswordConfig{BreachedList: filepath.Join(t.TempDir(), "missing.txt")})
+	if err == nil {
+		t.Error("got nil, want an error")
+	}
+}
@@ -0,0 +1,149 @@
+// Package problem writes error responses as RFC 7807 problem details
+// (application/problem+json).
+//
+// Every response carries a stable, machine-readable Code that clients can
+// switch on; Detail is the human-readable message and may change. The
+// request ID set by middleware.RequestID is repeated in the body so an
+// error report can be matched with the server logs and the audit log.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ContentType is the media type of problem responses
+const ContentType = "application/problem+json"
+
+// Codes of the problems the API reports
+const (
+	CodeBadRequest           = "bad_request"
+	CodeValidation           = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeMFARequired          = "mfa_required"
+	CodeOrgRequired          = "org_required"
+	CodeInsufficientScope    = "insufficient_scope"
+	CodeNotFound             = "not_found"
+	CodeConflict             = "conflict"
+	CodeAlreadyExists        = "already_exists"
+	CodeVersionMismatch      = "version_mismatch"
+	CodeUnprocessable        = "unprocessable"
+	CodeInsufficientStock    = "insufficient_stock"
+	CodePreconditionRequired = "precondition_required"
+	CodeTooManyRequests      = "too_many_requests"
+	CodeInternal             = "internal_error"
+	CodeBadGateway           = "bad_gateway"
+	CodeTimeout              = "timeout"
+)
+
+// statusCodes are the codes used when a response gives no specific one
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           CodeBadRequest,
+	http.StatusUnauthorized:         CodeUnauthorized,
+	http.StatusForbidden:            CodeForbidden,
+	http.StatusNotFound:             CodeNotFound,
+	http.StatusConflict:             CodeConflict,
+	http.StatusPreconditionFailed:   CodeVersionMismatch,
+	http.StatusUnprocessableEntity:  CodeUnprocessable,
+	http.StatusPreconditionRequired: CodePreconditionRequired,
+	http.StatusTooManyRequests:      CodeTooManyRequests,
+	http.StatusInternalServerError:  CodeInternal,
+	http.StatusBadGateway:           CodeBadGateway,
+	http.StatusServiceUnavailable:   CodeTimeout,
+}
+
+// Problem is the body of an error response. Type is always about:blank,
+// so Title is the HTTP status text; Errors maps request fields to what is
+// wrong with them. Extensions are extra members specific to the problem,
+// sent next to the standard ones.
+type Problem struct {
+	Type       string                 `json:"type"`
+	Title      string                 `json:"title"`
+	Status     int                    `json:"status"`
+	Detail     string                 `json:"detail,omitempty"`
+	Code       string                 `json:"code"`
+	Errors     map[string]string      `json:"errors,omitempty"`
+	RequestID  string                 `json:"request_id,omitempty"`
+	Extensions map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON flattens Extensions into the problem object. Extensions never
+// replace a standard member.
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type standard Problem
+	body, err := json.Marshal(standard(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return body, err
+	}
+
+	members := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, err
+	}
+	for name, value := range p.Extensions {
+		if _, ok := members[name]; ok {
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		members[name] = raw
+	}
+	return json.Marshal(members)
+}
+
+// Write sends p, filling in the fields it leaves empty
+func Write(writer http.ResponseWriter, p Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Code == "" {
+		p.Code = codeFor(p.Status)
+	}
+	if p.RequestID == "" {
+		p.RequestID = writer.Header().Get("X-Request-ID")
+	}
+
+	writer.Header().Set("Content-Type", ContentType)
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(p.Status)
+	json.NewEncoder(writer).Encode(p)
+}
+
+// Error replaces http.Error: it reports detail with the code of status
+func Error(writer http.ResponseWriter, detail string, status int) {
+	Write(writer, Problem{Status: status, Detail: detail})
+}
+
+// ErrorCode reports detail with a specific code
+func ErrorCode(writer http.ResponseWriter, detail string, status int, code string) {
+	Write(writer, Problem{Status: status, Detail: detail, Code: code})
+}
+
+// FieldErrors reports what is wrong with each of the given request fields
+func FieldErrors(writer http.ResponseWriter, detail string, status int, code string, fields map[string]string) {
+	Write(writer, Problem{Status: status, Detail: detail, Code: code, Errors: fields})
+}
+
+// Extended reports detail with a specific code and extra members
+func Extended(writer http.ResponseWriter, detail string, status int, code string, extensions map[string]interface{}) {
+	Write(writer, Problem{Status: status, Detail: detail, Code: code, Extensions: extensions})
+}
+
+// codeFor returns the default code of status, derived from its status text
+// for statuses without one
+func codeFor(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if text := http.StatusText(status); text != "" {
+		return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+	}
+	return CodeInternal
+}
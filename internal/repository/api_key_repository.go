@@ -0,0 +1,224 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/apikey"
+	"auth-register-sistem/internal/model/audit"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// APIKeyRepository stores service credentials. Keys look like
+// sk_<prefix>_<secret>; the prefix is stored in clear to find the key and
+// only a SHA-256 hash of the whole key is kept. Keys belong to an
+// organization and are listed and revoked within it. Creating and revoking
+// a key is recorded in the audit log.
+type APIKeyRepository interface {
+	Create(ctx context.Context, k apikey.APIKey, actor audit.Actor) (string, *apikey.APIKey, error)
+	List(ctx context.Context, orgID uuid.UUID) ([]apikey.APIKey, error)
+	Revoke(ctx context.Context, orgID, id uuid.UUID, actor audit.Actor) error
+	Authenticate(ctx context.Context, key string) (*apikey.APIKey, error)
+}
+
+type apiKeyRepo struct {
+	db *sql.DB
+}
+
+func NewAPIKeyRepository(db *sql.DB) APIKeyRepository {
+	return &apiKeyRepo{db: db}
+}
+
+const apiKeyColumns = "id, org_id, name, prefix, scopes, created_by, created_at, last_used_at, expires_at, revoked_at"
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*apikey.APIKey, error) {
+	k := &apikey.APIKey{}
+	err := row.Scan(&k.ID, &k.OrgID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.CreatedBy, &k.CreatedAt, &k.LastUsedAt, &k.ExpiresAt, &k.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// snapshotAPIKey returns key id of orgID as JSON for the audit log, without
+// its hash, or nil when it does not exist
+func snapshotAPIKey(ctx context.Context, tx *sql.Tx, orgID, id uuid.UUID) ([]byte, error) {
+	var snapshot []byte
+	err := tx.QueryRowContext(ctx,
+		`SELECT to_jsonb(k) - 'key_hash' FROM api_keys k WHERE k.id = $1 AND k.org_id = $2 FOR UPDATE`,
+		id, orgID).Scan(&snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to snapshot api key: %w", err)
+	}
+	return snapshot, nil
+}
+
+// auditAPIKey records a change of key id, comparing before with its state
+// now
+func auditAPIKey(ctx context.Context, tx *sql.Tx, orgID, id uuid.UUID, actor audit.Actor, action string, before []byte) error {
+	after, err := snapshotAPIKey(ctx, tx, orgID, id)
+	if err != nil {
+		return err
+	}
+	return recordAudit(ctx, tx, actor, audit.Entry{
+		OrgID:      uuid.NullUUID{UUID: orgID, Valid: true},
+		Action:     action,
+		EntityType: audit.EntityAPIKey,
+		EntityID:   id.String(),
+		Before:     before,
+		After:      after,
+	})
+}
+
+// prefixAttempts is how many random prefixes Create tries. The prefix is
+// only 32 bits, so two keys may draw the same one.
+const prefixAttempts = 3
+
+// Create stores a new key and returns it in clear, the only time it is
+// available. A prefix already taken is replaced by a new one.
+func (r *apiKeyRepo) Create(ctx context.Context, k apikey.APIKey, actor audit.Actor) (string, *apikey.APIKey, error) {
+	for attempt := 1; ; attempt++ {
+		key, created, err := r.create(ctx, k, actor)
+		var pqErr *pq.Error
+		if attempt < prefixAttempts && errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "api_keys_prefix_key" {
+			continue
+		}
+		return key, created, err
+	}
+}
+
+// create makes one attempt of Create with a fresh prefix and secret
+func (r *apiKeyRepo) create(ctx context.Context, k apikey.APIKey, actor audit.Actor) (string, *apikey.APIKey, error) {
+	prefix := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(prefix); err != nil {
+		return "", nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	k.Prefix = hex.EncodeToString(prefix)
+	key := apikey.Prefix + k.Prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	created, err := scanAPIKey(tx.QueryRowContext(ctx,
+		`INSERT INTO api_keys (org_id, name, prefix, key_hash, scopes, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+apiKeyColumns,
+		k.OrgID, k.Name, k.Prefix, hashToken(key), pq.Array(k.Scopes), k.CreatedBy, k.ExpiresAt))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create api key: %w", err)
+	}
+
+	if err := auditAPIKey(ctx, tx, k.OrgID, created.ID, actor, audit.ActionCreate, nil); err != nil {
+		return "", nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return key, created, nil
+}
+
+func (r *apiKeyRepo) List(ctx context.Context, orgID uuid.UUID) ([]apikey.APIKey, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE org_id = $1 ORDER BY created_at DESC", orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []apikey.APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		keys = append(keys, *k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return keys, nil
+}
+
+// Revoke disables a key for good
+func (r *apiKeyRepo) Revoke(ctx context.Context, orgID, id uuid.UUID, actor audit.Actor) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := snapshotAPIKey(ctx, tx, orgID, id)
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrNotFound
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE api_keys SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1 AND org_id = $2`, id, orgID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+
+	if err := auditAPIKey(ctx, tx, orgID, id, actor, audit.ActionRevoke, before); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Authenticate returns the active key matching key and records its use. It
+// returns ErrNotFound for unknown, revoked or expired keys.
+func (r *apiKeyRepo) Authenticate(ctx context.Context, key string) (*apikey.APIKey, error) {
+	rest, ok := strings.CutPrefix(key, apikey.Prefix)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	var hash string
+	row := r.db.QueryRowContext(ctx,
+		`SELECT key_hash, `+apiKeyColumns+` FROM api_keys
+		WHERE prefix = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())`,
+		prefix)
+	k := &apikey.APIKey{}
+	err := row.Scan(&hash, &k.ID, &k.OrgID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.CreatedBy, &k.CreatedAt, &k.LastUsedAt, &k.ExpiresAt, &k.RevokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find api key: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(key))) != 1 {
+		return nil, ErrNotFound
+	}
+
+	if _, err := r.db.ExecContext(ctx, `UPDATE api_keys SET last_used_at = now() WHERE id = $1`, k.ID); err != nil {
+		return nil, fmt.Errorf("failed to update api key: %w", err)
+	}
+	return k, nil
+}
@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/audit"
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// AuditRepository reads the audit log. Entries are only written by the
+// repositories making the changes, through recordAudit, in the same
+// transaction as the change itself.
+type AuditRepository interface {
+	List(ctx context.Context, f audit.Filter) ([]audit.Entry, error)
+	Verify(ctx context.Context) (audit.Verification, error)
+}
+
+type auditRepo struct {
+	db *sql.DB
+}
+
+func NewAuditRepository(db *sql.DB) AuditRepository {
+	return &auditRepo{db: db}
+}
+
+// auditLockKey seeds the advisory locks serializing the writers of each
+// chain of the audit log, so every entry links to the one committed right
+// before it in its chain.
+const auditLockKey = 0x6175646974
+
+// auditHash computes the hash of an audit_log row from its columns. It is
+// used both when writing and when verifying entries, so both always agree
+// on what is covered.
+const auditHash = `encode(sha256(convert_to(jsonb_build_array(prev_hash, org_id, actor_id, api_key_id,
+	action, entity_type, entity_id, before, after, request_id, ip, created_at)::text, 'UTF8')), 'hex')`
+
+// recordAudit appends e, made by actor, to the audit log inside tx. Every
+// organization, and the entries without one, has its own hash chain and
+// lock, so tenants do not wait on each other. The lock is held until tx
+// ends, so callers make it the last statement before committing.
+func recordAudit(ctx context.Context, tx *sql.Tx, actor audit.Actor, e audit.Entry) error {
+	chain, lockName := `org_id IS NULL`, ""
+	if e.OrgID.Valid {
+		chain, lockName = `org_id = $1`, e.OrgID.UUID.String()
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, $2))`, lockName, auditLockKey); err != nil {
+		return fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO audit_log (org_id, actor_id, api_key_id, action, entity_type, entity_id,
+			before, after, request_id, ip, created_at, prev_hash, hash, org_chain)
+		SELECT org_id, actor_id, api_key_id, action, entity_type, entity_id,
+			before, after, request_id, ip, created_at, prev_hash, `+auditHash+`, true
+		FROM (SELECT $1::uuid AS org_id, $2::uuid AS actor_id, $3::uuid AS api_key_id,
+			$4::text AS action, $5::text AS entity_type, $6::text AS entity_id,
+			$7::jsonb AS before, $8::jsonb AS after, $9::text AS request_id, $10::text AS ip,
+			now()::timestamp AS created_at,
+			COALESCE((SELECT hash FROM audit_log WHERE `+chain+` ORDER BY id DESC LIMIT 1), '') AS prev_hash) e`,
+		e.OrgID, actor.UserID, actor.APIKeyID, e.Action, e.EntityType, e.EntityID,
+		nullJSON(e.Before), nullJSON(e.After), actor.RequestID, actor.IP)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// nullJSON passes a JSON document as a query parameter. lib/pq sends
+// []byte as bytea, so it goes as a string, or NULL when empty.
+func nullJSON(raw []byte) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
+
+// List returns matching entries, newest first
+func (r *auditRepo) List(ctx context.Context, f audit.Filter) ([]audit.Entry, error) {
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT id, org_id, actor_id, api_key_id, action, entity_type, entity_id,
+			before, after, request_id, ip, created_at, prev_hash, hash
+		FROM audit_log
+		WHERE ($1::uuid IS NULL OR org_id = $1)
+			AND ($2::uuid IS NULL OR actor_id = $2)
+			AND ($3 = '' OR entity_type = $3)
+			AND ($4 = '' OR entity_id = $4)
+			AND ($5 = '' OR action = $5)
+			AND ($6::timestamp IS NULL OR created_at >= $6)
+			AND ($7::timestamp IS NULL OR created_at < $7)
+			AND ($8::bigint = 0 OR id < $8)
+		ORDER BY id DESC
+		LIMIT $9`,
+		f.OrgID, f.ActorID, f.EntityType, f.EntityID, f.Action, f.From, f.To, f.BeforeID, f.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []audit.Entry{}
+	for rows.Next() {
+		var e audit.Entry
+		var before, after []byte
+		err := rows.Scan(&e.ID, &e.OrgID, &e.ActorID, &e.APIKeyID, &e.Action, &e.EntityType, &e.EntityID,
+			&before, &after, &e.RequestID, &e.IP, &e.CreatedAt, &e.PrevHash, &e.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		e.Before, e.After = before, after
+		if e.Changes, err = audit.Diff(before, after); err != nil {
+			return nil, fmt.Errorf("failed to diff entry %d: %w", e.ID, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return entries, nil
+}
+
+// Verify walks the whole log in order, recomputing every hash and checking
+// that each entry links to the one before it in its chain. Entries written
+// before the log was split per organization (org_chain false) link to the
+// entry before them in the whole log.
+func (r *auditRepo) Verify(ctx context.Context) (audit.Verification, error) {
+	var v audit.Verification
+	rows, err := r.db.QueryContext(ctx, `SELECT id, org_id, org_chain, prev_hash, hash, `+auditHash+` FROM audit_log ORDER BY id`)
+	if err != nil {
+		return v, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer rows.Close()
+
+	prev := ""
+	prevInChain := map[uuid.NullUUID]string{}
+	for rows.Next() {
+		var id int64
+		var orgID uuid.NullUUID
+		var orgChain bool
+		var prevHash, hash, computed string
+		if err := rows.Scan(&id, &orgID, &orgChain, &prevHash, &hash, &computed); err != nil {
+			return v, fmt.Errorf("failed to scan row: %w", err)
+		}
+		v.Entries++
+		expected := prev
+		if orgChain {
+			expected = prevInChain[orgID]
+		}
+		if v.FirstInvalidID == 0 && (prevHash != expected || hash != computed) {
+			v.FirstInvalidID = id
+		}
+		prev = hash
+		prevInChain[orgID] = hash
+	}
+	if err := rows.Err(); err != nil {
+		return v, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	v.Valid = v.FirstInvalidID == 0
+	return v, nil
+}
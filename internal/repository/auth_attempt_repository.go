@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/auth"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type AuthAttemptRepository interface {
+	Record(ctx context.Context, a auth.Attempt) error
+	CountFailuresByIP(ctx context.Context, ip string, window time.Duration) (int, error)
+	List(ctx context.Context, username, ip string, limit int) ([]auth.Attempt, error)
+}
+
+type authAttemptRepo struct {
+	db *sql.DB
+}
+
+func NewAuthAttemptRepository(db *sql.DB) AuthAttemptRepository {
+	return &authAttemptRepo{db: db}
+}
+
+func (r *authAttemptRepo) Record(ctx context.Context, a auth.Attempt) error {
+	_, err := r.db.ExecContext(ctx,
+		`INSERT INTO auth_attempts (username, user_id, ip, user_agent, success, reason)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		a.Username, a.UserID, a.IP, a.UserAgent, a.Success, a.Reason)
+	if err != nil {
+		return fmt.Errorf("failed to record auth attempt: %w", err)
+	}
+	return nil
+}
+
+// CountFailuresByIP counts the failed attempts from ip within the window
+func (r *authAttemptRepo) CountFailuresByIP(ctx context.Context, ip string, window time.Duration) (int, error) {
+	var n int
+	err := r.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM auth_attempts
+		WHERE ip = $1 AND NOT success AND created_at > now() - $2 * interval '1 second'`,
+		ip, window.Seconds()).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count auth attempts: %w", err)
+	}
+	return n, nil
+}
+
+// List returns the latest attempts, optionally filtered by username and ip
+func (r *authAttemptRepo) List(ctx context.Context, username, ip string, limit int) ([]auth.Attempt, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT id, username, user_id, ip, user_agent, success, reason, created_at
+		FROM auth_attempts
+		WHERE ($1 = '' OR username = $1) AND ($2 = '' OR ip = $2)
+		ORDER BY created_at DESC
+		LIMIT $3`,
+		username, ip, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list auth attempts: %w", err)
+	}
+	defer rows.Close()
+
+	attempts := []auth.Attempt{}
+	for rows.Next() {
+		var a auth.Attempt
+		if err := rows.Scan(&a.ID, &a.Username, &a.UserID, &a.IP, &a.UserAgent, &a.Success, &a.Reason, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return attempts, nil
+}
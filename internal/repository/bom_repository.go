@@ -0,0 +1,256 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/bom"
+	"auth-register-sistem/internal/model/transaction"
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// BOMRepository manages bills of materials and kit operations. Changes to a
+// bill of materials, kit operations and the stock they move are written to
+// the audit log by actor in the same transaction.
+type BOMRepository interface {
+	SetBOM(ctx context.Context, orgID, kitID uuid.UUID, components []bom.Component, actor audit.Actor) error
+	GetBOM(ctx context.Context, orgID, kitID uuid.UUID) ([]bom.Component, error)
+	CreateOperation(ctx context.Context, orgID uuid.UUID, op bom.Operation, actor audit.Actor) (uuid.UUID, error)
+	GetBuildableQuantity(ctx context.Context, orgID, kitID uuid.UUID) (decimal.Decimal, error)
+}
+
+type bomRepo struct {
+	db *sql.DB
+}
+
+func NewBOMRepository(db *sql.DB) BOMRepository {
+	return &bomRepo{db: db}
+}
+
+// SetBOM replaces the bill of materials of a kit. The kit and its
+// components must belong to orgID, otherwise ErrNotFound is returned.
+func (r *bomRepo) SetBOM(ctx context.Context, orgID, kitID uuid.UUID, components []bom.Component, actor audit.Actor) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, `SELECT true FROM stock WHERE id = $1 AND org_id = $2 FOR UPDATE`, kitID, orgID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return fmt.Errorf("%w: kit %s", ErrNotFound, kitID)
+	} else if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to fetch kit: %w", err)
+	}
+
+	before, err := snapshotBOM(ctx, tx, kitID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM bom_components WHERE kit_id = $1`, kitID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to clear bill of materials: %w", err)
+	}
+
+	for _, c := range components {
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO bom_components (kit_id, component_id, quantity)
+			SELECT $1::uuid, id, $3::numeric FROM stock WHERE id = $2 AND org_id = $4`,
+			kitID, c.ComponentID, c.Quantity, orgID)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to add component %s: %w", c.ComponentID, uniqueViolation(err))
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			tx.Rollback()
+			return fmt.Errorf("%w: component %s", ErrNotFound, c.ComponentID)
+		}
+	}
+
+	after, err := snapshotBOM(ctx, tx, kitID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = recordAudit(ctx, tx, actor, audit.Entry{
+		OrgID:      uuid.NullUUID{UUID: orgID, Valid: true},
+		Action:     audit.ActionUpdate,
+		EntityType: audit.EntityBOM,
+		EntityID:   kitID.String(),
+		Before:     before,
+		After:      after,
+	})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// snapshotBOM returns the components of kitID as a JSON array, or nil when
+// the kit has none
+func snapshotBOM(ctx context.Context, tx *sql.Tx, kitID uuid.UUID) ([]byte, error) {
+	var snapshot []byte
+	err := tx.QueryRowContext(ctx,
+		`SELECT jsonb_agg(to_jsonb(b) ORDER BY b.component_id) FROM bom_components b WHERE b.kit_id = $1`,
+		kitID).Scan(&snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot bill of materials: %w", err)
+	}
+	return snapshot, nil
+}
+
+func (r *bomRepo) GetBOM(ctx context.Context, orgID, kitID uuid.UUID) ([]bom.Component, error) {
+	return queryBOM(ctx, r.db, orgID, kitID)
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryBOM(ctx context.Context, q queryer, orgID, kitID uuid.UUID) ([]bom.Component, error) {
+	rows, err := q.QueryContext(ctx,
+		`SELECT b.kit_id, b.component_id, s.name, b.quantity
+		FROM bom_components b JOIN stock s ON s.id = b.component_id
+		WHERE b.kit_id = $1 AND s.org_id = $2`, kitID, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bill of materials: %w", err)
+	}
+	defer rows.Close()
+
+	var components []bom.Component
+	for rows.Next() {
+		var c bom.Component
+		if err := rows.Scan(&c.KitID, &c.ComponentID, &c.Name, &c.Quantity); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		components = append(components, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return components, nil
+}
+
+// CreateOperation assembles or disassembles op.Quantity kits. Component and
+// kit quantities are moved through applyStockMovement, so every affected
+// stock row is locked with FOR UPDATE, recorded in the ledger with the
+// operation ID as reference and audited, all in one DB transaction.
+func (r *bomRepo) CreateOperation(ctx context.Context, orgID uuid.UUID, op bom.Operation, actor audit.Actor) (uuid.UUID, error) {
+	op.ID = uuid.New()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	var kitName string
+	err = tx.QueryRowContext(ctx, `SELECT name FROM stock WHERE id = $1 AND org_id = $2 AND deleted_at IS NULL`, op.KitID, orgID).Scan(&kitName)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("%w: kit %s", ErrNotFound, op.KitID)
+	} else if err != nil {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("failed to fetch kit: %w", err)
+	}
+
+	components, err := queryBOM(ctx, tx, orgID, op.KitID)
+	if err != nil {
+		tx.Rollback()
+		return uuid.Nil, err
+	}
+	if len(components) == 0 {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("%w: kit has no bill of materials", ErrInvalid)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO kit_operations (id, org_id, kit_id, type, quantity, created_by) VALUES ($1, $2, $3, $4, $5, $6)`,
+		op.ID, orgID, op.KitID, op.Type, op.Quantity, op.CreatedBy)
+	if err != nil {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("failed to create kit operation: %w", err)
+	}
+
+	var after []byte
+	err = tx.QueryRowContext(ctx, `SELECT to_jsonb(o) FROM kit_operations o WHERE o.id = $1`, op.ID).Scan(&after)
+	if err != nil {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("failed to snapshot kit operation: %w", err)
+	}
+	err = recordAudit(ctx, tx, actor, audit.Entry{
+		OrgID:      uuid.NullUUID{UUID: orgID, Valid: true},
+		Action:     audit.ActionCreate,
+		EntityType: audit.EntityKitOperation,
+		EntityID:   op.ID.String(),
+		After:      after,
+	})
+	if err != nil {
+		tx.Rollback()
+		return uuid.Nil, err
+	}
+
+	componentType, kitType := transaction.TypeOut, transaction.TypeIn
+	if op.Type == bom.TypeDisassembly {
+		componentType, kitType = transaction.TypeIn, transaction.TypeOut
+	}
+
+	movements := []transaction.Transaction{{Name: kitName, Quantity: op.Quantity, Type: kitType}}
+	for _, c := range components {
+		movements = append(movements, transaction.Transaction{Name: c.Name, Quantity: c.Quantity.Mul(op.Quantity), Type: componentType})
+	}
+
+	// Lock rows in a stable order so concurrent operations sharing
+	// components cannot deadlock each other.
+	sort.Slice(movements, func(i, j int) bool { return movements[i].Name < movements[j].Name })
+
+	for _, m := range movements {
+		m.ID = uuid.New()
+		m.ReferenceID = uuid.NullUUID{UUID: op.ID, Valid: true}
+		m.CreatedBy = op.CreatedBy
+		if err := applyStockMovement(ctx, tx, orgID, m, actor); err != nil {
+			tx.Rollback()
+			return uuid.Nil, fmt.Errorf("%s: %w", m.Name, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return op.ID, nil
+}
+
+// GetBuildableQuantity reports how many kits can be assembled from the
+// components currently in stock.
+func (r *bomRepo) GetBuildableQuantity(ctx context.Context, orgID, kitID uuid.UUID) (decimal.Decimal, error) {
+	var buildable decimal.NullDecimal
+	err := r.db.QueryRowContext(ctx,
+		`SELECT MIN(TRUNC(s.quantity / b.quantity, k.precision))
+		FROM bom_components b
+		JOIN stock s ON s.id = b.component_id
+		JOIN stock k ON k.id = b.kit_id
+		WHERE b.kit_id = $1 AND k.org_id = $2`, kitID, orgID).Scan(&buildable)
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("failed to compute buildable quantity: %w", err)
+	}
+	if !buildable.Valid {
+		return decimal.Zero, fmt.Errorf("%w: kit has no bill of materials", ErrInvalid)
+	}
+	return buildable.Decimal, nil
+}
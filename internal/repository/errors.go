@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	// ErrNotFound is returned when the requested row does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrVersionMismatch is returned when a row was changed since the
+	// version the caller based its update on.
+	ErrVersionMismatch = errors.New("version mismatch")
+
+	// ErrConflict is returned when an operation is not allowed in the
+	// current state of the row.
+	ErrConflict = errors.New("conflict")
+
+	// ErrInvalid is returned when a well-formed request cannot be applied
+	// to the stored data, such as an unknown unit or more decimal places
+	// than a product allows.
+	ErrInvalid = errors.New("invalid")
+
+	// ErrInsufficientStock is matched by InsufficientStockError, returned
+	// when a movement would take more than the quantity in stock.
+	ErrInsufficientStock = errors.New("insufficient stock")
+)
+
+// InsufficientStockError reports how much of a product was requested and
+// how much is available. It matches ErrInsufficientStock with errors.Is.
+type InsufficientStockError struct {
+	Product   string
+	Available decimal.Decimal
+	Requested decimal.Decimal
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock of %s: %s available, %s requested", e.Product, e.Available, e.Requested)
+}
+
+func (e *InsufficientStockError) Unwrap() error {
+	return ErrInsufficientStock
+}
+
+// IsTimeout reports whether err comes from a query cancelled with its
+// context, for example when the request deadline passed, or from a
+// statement that waited longer than the lock timeout for a locked row.
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "57014" || pqErr.Code == "55P03")
+}
+
+// UniqueViolationError reports the field of a row that collided with an
+// existing one. It matches ErrConflict with errors.Is.
+type UniqueViolationError struct {
+	Field string
+}
+
+func (e *UniqueViolationError) Error() string {
+	return e.Field + " already exists"
+}
+
+func (e *UniqueViolationError) Unwrap() error {
+	return ErrConflict
+}
+
+// uniqueFields maps unique constraint names to the field they guard.
+var uniqueFields = map[string]string{
+	"users_username_key":     "username",
+	"users_email_key":        "email",
+	"organizations_slug_key": "slug",
+	"org_members_pkey":       "member",
+	"stock_org_sku_key":      "sku",
+	"product_units_pkey":     "units",
+	"bom_components_pkey":    "components",
+	"user_identities_pkey":   "identity",
+}
+
+// uniqueViolation turns a Postgres unique violation into a
+// UniqueViolationError and returns any other error unchanged.
+func uniqueViolation(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err
+	}
+	field, ok := uniqueFields[pqErr.Constraint]
+	if !ok {
+		field = pqErr.Constraint
+	}
+	return &UniqueViolationError{Field: field}
+}
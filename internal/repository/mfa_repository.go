@@ -0,0 +1,226 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/user"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// MFARepository stores TOTP secrets and recovery codes. Recovery codes are
+// stored as SHA-256 hashes and can each be used once.
+type MFARepository interface {
+	GetMFA(ctx context.Context, userID uuid.UUID) (*user.MFA, error)
+	SetPendingSecret(ctx context.Context, userID uuid.UUID, secret string) error
+	Enable(ctx context.Context, userID uuid.UUID, counter int64, actor audit.Actor) ([]string, error)
+	Disable(ctx context.Context, userID uuid.UUID, actor audit.Actor) error
+	UseCounter(ctx context.Context, userID uuid.UUID, counter int64) error
+	UseRecoveryCode(ctx context.Context, userID uuid.UUID, code string) error
+	ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error)
+}
+
+type mfaRepo struct {
+	db *sql.DB
+}
+
+func NewMFARepository(db *sql.DB) MFARepository {
+	return &mfaRepo{db: db}
+}
+
+// normalizeRecoveryCode accepts codes with or without the dash and in any case
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func (r *mfaRepo) GetMFA(ctx context.Context, userID uuid.UUID) (*user.MFA, error) {
+	var secret sql.NullString
+	var lastCounter sql.NullInt64
+	m := &user.MFA{}
+	err := r.db.QueryRowContext(ctx,
+		`SELECT mfa_secret, mfa_enabled_at, mfa_last_counter FROM users WHERE id = $1`, userID,
+	).Scan(&secret, &m.EnabledAt, &lastCounter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get mfa: %w", err)
+	}
+	m.Secret, m.LastCounter = secret.String, lastCounter.Int64
+	return m, nil
+}
+
+// SetPendingSecret stores a secret that is not enforced until Enable. It
+// returns ErrConflict if MFA is already enabled.
+func (r *mfaRepo) SetPendingSecret(ctx context.Context, userID uuid.UUID, secret string) error {
+	res, err := r.db.ExecContext(ctx,
+		`UPDATE users SET mfa_secret = $1, mfa_last_counter = NULL WHERE id = $2 AND mfa_enabled_at IS NULL`,
+		secret, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set mfa secret: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// Enable turns on MFA after the first valid code, which is recorded as
+// used, and returns a fresh set of recovery codes. It is recorded in the
+// audit log.
+func (r *mfaRepo) Enable(ctx context.Context, userID uuid.UUID, counter int64, actor audit.Actor) ([]string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := snapshotUser(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE users SET mfa_enabled_at = now(), mfa_last_counter = $1, updated_at = now()
+		WHERE id = $2 AND mfa_secret IS NOT NULL AND mfa_enabled_at IS NULL`,
+		counter, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable mfa: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrConflict
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := auditUser(ctx, tx, actor, audit.ActionEnableMFA, userID, before); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return codes, nil
+}
+
+// Disable turns MFA off and deletes the recovery codes, recording it in
+// the audit log
+func (r *mfaRepo) Disable(ctx context.Context, userID uuid.UUID, actor audit.Actor) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := snapshotUser(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrNotFound
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE users SET mfa_secret = NULL, mfa_enabled_at = NULL, mfa_last_counter = NULL, updated_at = now()
+		WHERE id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to disable mfa: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	if err := auditUser(ctx, tx, actor, audit.ActionDisableMFA, userID, before); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// UseCounter records a TOTP step as used. It returns ErrConflict when the
+// step is not newer than the last one accepted, so codes cannot be replayed.
+func (r *mfaRepo) UseCounter(ctx context.Context, userID uuid.UUID, counter int64) error {
+	res, err := r.db.ExecContext(ctx,
+		`UPDATE users SET mfa_last_counter = $1
+		WHERE id = $2 AND (mfa_last_counter IS NULL OR mfa_last_counter < $1)`,
+		counter, userID)
+	if err != nil {
+		return fmt.Errorf("failed to use mfa code: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// UseRecoveryCode consumes a recovery code, returning ErrNotFound if it is
+// unknown or already used.
+func (r *mfaRepo) UseRecoveryCode(ctx context.Context, userID uuid.UUID, code string) error {
+	res, err := r.db.ExecContext(ctx,
+		`UPDATE mfa_recovery_codes SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mfaRepo) ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return codes, nil
+}
+
+// replaceRecoveryCodes discards the recovery codes of userID and returns
+// new ones formatted as XXXXX-XXXXX.
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID uuid.UUID) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	codes := make([]string, user.RecoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		code := base32.StdEncoding.EncodeToString(raw)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, hashToken(code))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create recovery code: %w", err)
+		}
+	}
+	return codes, nil
+}
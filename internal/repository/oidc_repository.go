@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/user"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OIDCRepository keeps the pending logins of the authorization code flow
+// and the provider identities linked to each user.
+type OIDCRepository interface {
+	SaveState(ctx context.Context, state, provider, nonce, verifier string, ttl time.Duration) error
+	ConsumeState(ctx context.Context, state, provider string) (nonce, verifier string, err error)
+	FindUserByIdentity(ctx context.Context, provider, subject string) (*user.User, error)
+	LinkIdentity(ctx context.Context, userID uuid.UUID, provider, subject, email string) error
+	CreateUserWithIdentity(ctx context.Context, u user.User, provider, subject string, actor audit.Actor) (uuid.UUID, error)
+}
+
+type oidcRepo struct {
+	db *sql.DB
+}
+
+func NewOIDCRepository(db *sql.DB) OIDCRepository {
+	return &oidcRepo{db: db}
+}
+
+// SaveState stores the nonce and PKCE verifier of a login started with
+// state. Only a hash of the state is kept.
+func (r *oidcRepo) SaveState(ctx context.Context, state, provider, nonce, verifier string, ttl time.Duration) error {
+	// Expired states are never consumed, so they are cleaned up here
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM oidc_login_states WHERE expires_at < now()`); err != nil {
+		return fmt.Errorf("failed to delete expired states: %w", err)
+	}
+
+	_, err := r.db.ExecContext(ctx,
+		`INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, expires_at)
+		VALUES ($1, $2, $3, $4, now() + $5 * interval '1 second')`,
+		hashToken(state), provider, nonce, verifier, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	return nil
+}
+
+// ConsumeState deletes a pending login and returns its nonce and verifier.
+// It returns ErrNotFound for unknown or expired states.
+func (r *oidcRepo) ConsumeState(ctx context.Context, state, provider string) (string, string, error) {
+	var nonce, verifier string
+	err := r.db.QueryRowContext(ctx,
+		`DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND provider = $2 AND expires_at > now()
+		RETURNING nonce, code_verifier`,
+		hashToken(state), provider).Scan(&nonce, &verifier)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrNotFound
+	} else if err != nil {
+		return "", "", fmt.Errorf("failed to consume state: %w", err)
+	}
+	return nonce, verifier, nil
+}
+
+// FindUserByIdentity returns the user linked to a provider subject, or
+// ErrNotFound if there is none, and records the login.
+func (r *oidcRepo) FindUserByIdentity(ctx context.Context, provider, subject string) (*user.User, error) {
+	u, err := scanUser(r.db.QueryRowContext(ctx,
+		`WITH identity AS (
+			UPDATE user_identities SET last_login_at = now()
+			WHERE provider = $1 AND subject = $2
+			RETURNING user_id
+		)
+		SELECT `+userColumns+` FROM users WHERE id = (SELECT user_id FROM identity)`,
+		provider, subject))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to find identity: %w", err)
+	}
+	return u, nil
+}
+
+func (r *oidcRepo) LinkIdentity(ctx context.Context, userID uuid.UUID, provider, subject, email string) error {
+	_, err := r.db.ExecContext(ctx,
+		`INSERT INTO user_identities (provider, subject, user_id, email, last_login_at)
+		VALUES ($1, $2, $3, $4, now())`,
+		provider, subject, userID, email)
+	if err != nil {
+		return fmt.Errorf("failed to link identity: %w", uniqueViolation(err))
+	}
+	return nil
+}
+
+// CreateUserWithIdentity provisions an account on its first sign-in through
+// a provider, with the user role like Create.
+func (r *oidcRepo) CreateUserWithIdentity(ctx context.Context, u user.User, provider, subject string, actor audit.Actor) (uuid.UUID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	id := uuid.New()
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO users (id, name, username, email, password, role, email_verified_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		id, u.Name, u.Username, u.Email, u.Password, user.RoleUser, u.EmailVerifiedAt)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to create user: %w", uniqueViolation(err))
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO user_identities (provider, subject, user_id, email, last_login_at)
+		VALUES ($1, $2, $3, $4, now())`,
+		provider, subject, id, u.Email)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to link identity: %w", uniqueViolation(err))
+	}
+
+	if err := auditUser(ctx, tx, actor, audit.ActionCreate, id, nil); err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return id, nil
+}
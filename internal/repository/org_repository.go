@@ -0,0 +1,272 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/org"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// OrgRepository manages organizations and their memberships. Every
+// organization keeps at least one admin: removing or demoting the last one
+// returns ErrConflict. Membership changes are written to the audit log by
+// actor in the same transaction.
+type OrgRepository interface {
+	Create(ctx context.Context, o org.Organization, ownerID uuid.UUID, actor audit.Actor) (uuid.UUID, error)
+	ListForUser(ctx context.Context, userID uuid.UUID) ([]org.Organization, error)
+	GetRole(ctx context.Context, orgID, userID uuid.UUID) (string, error)
+	DefaultForUser(ctx context.Context, userID uuid.UUID) (uuid.NullUUID, error)
+	ListMembers(ctx context.Context, orgID uuid.UUID) ([]org.Member, error)
+	AddMember(ctx context.Context, orgID, userID uuid.UUID, role string, actor audit.Actor) error
+	SetMemberRole(ctx context.Context, orgID, userID uuid.UUID, role string, actor audit.Actor) error
+	RemoveMember(ctx context.Context, orgID, userID uuid.UUID, actor audit.Actor) error
+}
+
+type orgRepo struct {
+	db *sql.DB
+}
+
+func NewOrgRepository(db *sql.DB) OrgRepository {
+	return &orgRepo{db: db}
+}
+
+// Create inserts an organization with ownerID as its first admin
+func (r *orgRepo) Create(ctx context.Context, o org.Organization, ownerID uuid.UUID, actor audit.Actor) (uuid.UUID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	id := uuid.New()
+	_, err = tx.ExecContext(ctx, `INSERT INTO organizations (id, name, slug) VALUES ($1, $2, $3)`, id, o.Name, o.Slug)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to create organization: %w", uniqueViolation(err))
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)`,
+		id, ownerID, org.RoleAdmin)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to add owner: %w", err)
+	}
+	if err := auditMember(ctx, tx, id, ownerID, actor, audit.ActionCreate, nil); err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return id, nil
+}
+
+// ListForUser lists the organizations userID belongs to, with their role
+func (r *orgRepo) ListForUser(ctx context.Context, userID uuid.UUID) ([]org.Organization, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT o.id, o.name, o.slug, m.role, o.created_at
+		FROM organizations o JOIN org_members m ON m.org_id = o.id
+		WHERE m.user_id = $1
+		ORDER BY o.name`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list organizations: %w", err)
+	}
+	defer rows.Close()
+
+	orgs := []org.Organization{}
+	for rows.Next() {
+		var o org.Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.Slug, &o.Role, &o.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		orgs = append(orgs, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return orgs, nil
+}
+
+// GetRole returns the role of userID in orgID, or ErrNotFound if they are
+// not a member
+func (r *orgRepo) GetRole(ctx context.Context, orgID, userID uuid.UUID) (string, error) {
+	var role string
+	err := r.db.QueryRowContext(ctx,
+		`SELECT role FROM org_members WHERE org_id = $1 AND user_id = $2`,
+		orgID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("failed to find membership: %w", err)
+	}
+	return role, nil
+}
+
+// DefaultForUser returns the organization userID joined first, which their
+// tokens are issued for at login
+func (r *orgRepo) DefaultForUser(ctx context.Context, userID uuid.UUID) (uuid.NullUUID, error) {
+	var id uuid.NullUUID
+	err := r.db.QueryRowContext(ctx,
+		`SELECT org_id FROM org_members WHERE user_id = $1 ORDER BY created_at, org_id LIMIT 1`,
+		userID).Scan(&id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return uuid.NullUUID{}, fmt.Errorf("failed to find organization: %w", err)
+	}
+	return id, nil
+}
+
+func (r *orgRepo) ListMembers(ctx context.Context, orgID uuid.UUID) ([]org.Member, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT u.id, u.username, u.name, u.email, m.role, m.created_at
+		FROM org_members m JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = $1
+		ORDER BY u.username`, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members: %w", err)
+	}
+	defer rows.Close()
+
+	members := []org.Member{}
+	for rows.Next() {
+		var m org.Member
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Name, &m.Email, &m.Role, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return members, nil
+}
+
+// AddMember adds userID to orgID. Adding an existing member returns a
+// UniqueViolationError.
+func (r *orgRepo) AddMember(ctx context.Context, orgID, userID uuid.UUID, role string, actor audit.Actor) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)`,
+		orgID, userID, role)
+	if err != nil {
+		return fmt.Errorf("failed to add member: %w", uniqueViolation(err))
+	}
+
+	if err := auditMember(ctx, tx, orgID, userID, actor, audit.ActionCreate, nil); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *orgRepo) SetMemberRole(ctx context.Context, orgID, userID uuid.UUID, role string, actor audit.Actor) error {
+	return r.changeMember(ctx, orgID, userID, actor, audit.ActionUpdate, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			`UPDATE org_members SET role = $1 WHERE org_id = $2 AND user_id = $3`,
+			role, orgID, userID)
+		return err
+	}, role != org.RoleAdmin)
+}
+
+func (r *orgRepo) RemoveMember(ctx context.Context, orgID, userID uuid.UUID, actor audit.Actor) error {
+	return r.changeMember(ctx, orgID, userID, actor, audit.ActionDelete, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM org_members WHERE org_id = $1 AND user_id = $2`, orgID, userID)
+		return err
+	}, true)
+}
+
+// changeMember applies change to an existing membership. When dropsAdmin
+// is set and the member is the last admin, nothing is changed. The
+// organization row is locked so concurrent changes cannot remove the last
+// two admins at once.
+func (r *orgRepo) changeMember(ctx context.Context, orgID, userID uuid.UUID, actor audit.Actor, action string, change func(tx *sql.Tx) error, dropsAdmin bool) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, `SELECT true FROM organizations WHERE id = $1 FOR UPDATE`, orgID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to lock organization: %w", err)
+	}
+
+	var role string
+	var admins int
+	err = tx.QueryRowContext(ctx,
+		`SELECT role, (SELECT COUNT(*) FROM org_members WHERE org_id = $1 AND role = $3)
+		FROM org_members WHERE org_id = $1 AND user_id = $2`,
+		orgID, userID, org.RoleAdmin).Scan(&role, &admins)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to find membership: %w", err)
+	}
+
+	if dropsAdmin && role == org.RoleAdmin && admins == 1 {
+		return fmt.Errorf("%w: an organization needs at least one admin", ErrConflict)
+	}
+
+	before, err := snapshotMember(ctx, tx, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := change(tx); err != nil {
+		return fmt.Errorf("failed to change membership: %w", err)
+	}
+
+	if err := auditMember(ctx, tx, orgID, userID, actor, action, before); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// snapshotMember returns a membership as JSON for the audit log, or nil
+// when there is none
+func snapshotMember(ctx context.Context, tx *sql.Tx, orgID, userID uuid.UUID) ([]byte, error) {
+	var snapshot []byte
+	err := tx.QueryRowContext(ctx,
+		`SELECT to_jsonb(m) FROM org_members m WHERE m.org_id = $1 AND m.user_id = $2`,
+		orgID, userID).Scan(&snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to snapshot membership: %w", err)
+	}
+	return snapshot, nil
+}
+
+// auditMember records a change of the membership of userID in orgID,
+// comparing before with its state now
+func auditMember(ctx context.Context, tx *sql.Tx, orgID, userID uuid.UUID, actor audit.Actor, action string, before []byte) error {
+	after, err := snapshotMember(ctx, tx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	return recordAudit(ctx, tx, actor, audit.Entry{
+		OrgID:      uuid.NullUUID{UUID: orgID, Valid: true},
+		Action:     action,
+		EntityType: audit.EntityOrgMember,
+		EntityID:   userID.String(),
+		Before:     before,
+		After:      after,
+	})
+}
@@ -0,0 +1,185 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/pricing"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// PriceListRepository stores price lists and their prices. Creating a list
+// and changing its prices is recorded in the audit log.
+type PriceListRepository interface {
+	CreatePriceList(ctx context.Context, orgID uuid.UUID, pl pricing.PriceList, actor audit.Actor) (uuid.UUID, error)
+	GetAllPriceLists(ctx context.Context, orgID uuid.UUID) ([]pricing.PriceList, error)
+	SetPrices(ctx context.Context, orgID, priceListID uuid.UUID, items []pricing.Item, actor audit.Actor) error
+	GetPrices(ctx context.Context, orgID, priceListID uuid.UUID) ([]pricing.Item, error)
+}
+
+type priceListRepo struct {
+	db *sql.DB
+}
+
+func NewPriceListRepository(db *sql.DB) PriceListRepository {
+	return &priceListRepo{db: db}
+}
+
+// snapshotPriceList returns price list id of orgID with its prices as JSON
+// for the audit log, or nil when it does not exist
+func snapshotPriceList(ctx context.Context, tx *sql.Tx, orgID, id uuid.UUID) ([]byte, error) {
+	var snapshot []byte
+	err := tx.QueryRowContext(ctx,
+		`SELECT to_jsonb(l) || jsonb_build_object('items', COALESCE((
+			SELECT jsonb_agg(jsonb_build_object('product_id', i.product_id, 'price', i.price) ORDER BY i.product_id)
+			FROM price_list_items i WHERE i.price_list_id = l.id), '[]'::jsonb))
+		FROM price_lists l WHERE l.id = $1 AND l.org_id = $2 FOR UPDATE`,
+		id, orgID).Scan(&snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to snapshot price list: %w", err)
+	}
+	return snapshot, nil
+}
+
+// auditPriceList records a change of price list id, comparing before with
+// its state now
+func auditPriceList(ctx context.Context, tx *sql.Tx, orgID, id uuid.UUID, actor audit.Actor, action string, before []byte) error {
+	after, err := snapshotPriceList(ctx, tx, orgID, id)
+	if err != nil {
+		return err
+	}
+	return recordAudit(ctx, tx, actor, audit.Entry{
+		OrgID:      uuid.NullUUID{UUID: orgID, Valid: true},
+		Action:     action,
+		EntityType: audit.EntityPriceList,
+		EntityID:   id.String(),
+		Before:     before,
+		After:      after,
+	})
+}
+
+func (r *priceListRepo) CreatePriceList(ctx context.Context, orgID uuid.UUID, pl pricing.PriceList, actor audit.Actor) (uuid.UUID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	id := uuid.New()
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO price_lists (id, org_id, name, currency, valid_from, valid_to, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		id, orgID, pl.Name, pl.Currency, pl.ValidFrom, pl.ValidTo, pl.CreatedBy)
+	if err != nil {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("failed to create price list: %w", err)
+	}
+
+	if err := auditPriceList(ctx, tx, orgID, id, actor, audit.ActionCreate, nil); err != nil {
+		tx.Rollback()
+		return uuid.Nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return id, nil
+}
+
+func (r *priceListRepo) GetAllPriceLists(ctx context.Context, orgID uuid.UUID) ([]pricing.PriceList, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT id, name, currency, valid_from, valid_to, created_by, created_at
+		FROM price_lists WHERE org_id = $1 ORDER BY name, valid_from NULLS FIRST`, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get price lists: %w", err)
+	}
+	defer rows.Close()
+
+	lists := []pricing.PriceList{}
+	for rows.Next() {
+		var pl pricing.PriceList
+		if err := rows.Scan(&pl.ID, &pl.Name, &pl.Currency, &pl.ValidFrom, &pl.ValidTo, &pl.CreatedBy, &pl.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		lists = append(lists, pl)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return lists, nil
+}
+
+// SetPrices adds or updates prices on a price list. Products not in items
+// keep their current price. The list and the products must belong to
+// orgID; ErrNotFound is returned for an unknown list.
+func (r *priceListRepo) SetPrices(ctx context.Context, orgID, priceListID uuid.UUID, items []pricing.Item, actor audit.Actor) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	before, err := snapshotPriceList(ctx, tx, orgID, priceListID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if before == nil {
+		tx.Rollback()
+		return ErrNotFound
+	}
+
+	for _, item := range items {
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO price_list_items (price_list_id, product_id, price)
+			SELECT $1::uuid, id, $3::numeric FROM stock WHERE id = $2 AND org_id = $4
+			ON CONFLICT (price_list_id, product_id) DO UPDATE SET price = EXCLUDED.price`,
+			priceListID, item.ProductID, item.Price, orgID)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to set price for %s: %w", item.ProductID, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			tx.Rollback()
+			return fmt.Errorf("%w: product %s", ErrNotFound, item.ProductID)
+		}
+	}
+
+	if err := auditPriceList(ctx, tx, orgID, priceListID, actor, audit.ActionSetPrices, before); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *priceListRepo) GetPrices(ctx context.Context, orgID, priceListID uuid.UUID) ([]pricing.Item, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT i.product_id, i.price FROM price_list_items i JOIN price_lists l ON l.id = i.price_list_id
+		WHERE i.price_list_id = $1 AND l.org_id = $2`, priceListID, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prices: %w", err)
+	}
+	defer rows.Close()
+
+	items := []pricing.Item{}
+	for rows.Next() {
+		var item pricing.Item
+		if err := rows.Scan(&item.ProductID, &item.Price); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return items, nil
+}
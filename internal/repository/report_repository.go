@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/report"
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+type ReportRepository interface {
+	GetMarginReport(ctx context.Context, orgID uuid.UUID, from, to sql.NullTime) ([]report.MarginLine, error)
+}
+
+type reportRepo struct {
+	db *sql.DB
+}
+
+func NewReportRepository(db *sql.DB) ReportRepository {
+	return &reportRepo{db: db}
+}
+
+// GetMarginReport combines EXIT transactions in [from, to), less the
+// returns of that period, with the weighted average cost of all ENTRY
+// transactions booked before to. Lines are per product and currency, so
+// sums never mix currencies. EXIT transactions without a unit price count
+// towards quantity but not revenue. Movements of products that no longer
+// exist are grouped by name.
+func (r *reportRepo) GetMarginReport(ctx context.Context, orgID uuid.UUID, from, to sql.NullTime) ([]report.MarginLine, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`WITH movements AS (
+			SELECT product_id, name, COALESCE(currency, '') AS currency,
+				quantity, COALESCE(quantity * unit_price, 0) AS revenue
+			FROM transactions
+			WHERE org_id = $3 AND type = 'EXIT'
+				AND ($1::timestamp IS NULL OR created_at >= $1)
+				AND ($2::timestamp IS NULL OR created_at < $2)
+			UNION ALL
+			SELECT t.product_id, t.name, COALESCE(t.currency, ''),
+				-r.quantity, -COALESCE(r.quantity * t.unit_price, 0)
+			FROM returns r JOIN transactions t ON t.id = r.transaction_id
+			WHERE r.org_id = $3
+				AND ($1::timestamp IS NULL OR r.created_at >= $1)
+				AND ($2::timestamp IS NULL OR r.created_at < $2)
+		), sales AS (
+			SELECT product_id, MIN(name) AS name, currency, SUM(quantity) AS quantity, SUM(revenue) AS revenue
+			FROM movements
+			GROUP BY product_id, currency, CASE WHEN product_id IS NULL THEN name END
+		), costs AS (
+			SELECT product_id, currency, SUM(quantity * unit_price) / NULLIF(SUM(quantity), 0) AS average_cost
+			FROM transactions
+			WHERE org_id = $3 AND type = 'ENTRY' AND unit_price IS NOT NULL AND product_id IS NOT NULL
+				AND ($2::timestamp IS NULL OR created_at < $2)
+			GROUP BY product_id, currency
+		)
+		SELECT sa.product_id, COALESCE(s.name, sa.name), sa.currency, sa.quantity, sa.revenue,
+			COALESCE(c.average_cost, CASE WHEN s.currency = sa.currency THEN s.cost_price END)
+		FROM sales sa
+		LEFT JOIN costs c ON c.product_id = sa.product_id AND c.currency = sa.currency
+		LEFT JOIN stock s ON s.id = sa.product_id
+		ORDER BY sa.currency, 2`, from, to, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get margin report: %w", err)
+	}
+	defer rows.Close()
+
+	hundred := decimal.NewFromInt(100)
+	lines := []report.MarginLine{}
+	for rows.Next() {
+		var l report.MarginLine
+		if err := rows.Scan(&l.ProductID, &l.Name, &l.Currency, &l.QuantitySold, &l.Revenue, &l.AverageCost); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if l.AverageCost.Valid {
+			l.AverageCost.Decimal = l.AverageCost.Decimal.Round(4)
+			cost := l.QuantitySold.Mul(l.AverageCost.Decimal).Round(2)
+			margin := l.Revenue.Sub(cost)
+			l.Cost = decimal.NewNullDecimal(cost)
+			l.Margin = decimal.NewNullDecimal(margin)
+			if !l.Revenue.IsZero() {
+				l.MarginPercent = decimal.NewNullDecimal(margin.Div(l.Revenue).Mul(hundred).Round(2))
+			}
+		}
+		lines = append(lines, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return lines, nil
+}
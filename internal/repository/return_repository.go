@@ -0,0 +1,185 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/rma"
+	"auth-register-sistem/internal/model/stock"
+	"auth-register-sistem/internal/model/transaction"
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// ReturnRepository records customer returns. The return, the restocking
+// ledger entry and the stock change are written to the audit log by actor in
+// the same transaction.
+type ReturnRepository interface {
+	CreateReturn(ctx context.Context, orgID uuid.UUID, ret rma.Return, actor audit.Actor) (uuid.UUID, error)
+	GetAllReturns(ctx context.Context, orgID uuid.UUID) ([]rma.Return, error)
+}
+
+type returnRepo struct {
+	db *sql.DB
+}
+
+func NewReturnRepository(db *sql.DB) ReturnRepository {
+	return &returnRepo{db: db}
+}
+
+// CreateReturn records a customer return against an EXIT transaction. The
+// restocked portion is booked as a RETURN ledger entry that increases stock,
+// and the quarantined portion is added to the product's quarantine count.
+// Everything happens in a single DB transaction.
+func (r *returnRepo) CreateReturn(ctx context.Context, orgID uuid.UUID, ret rma.Return, actor audit.Actor) (uuid.UUID, error) {
+	ret.ID = uuid.New()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	// Lock the original transaction so concurrent returns against it are
+	// checked against an up to date returned total.
+	var shipped decimal.Decimal
+	var txType transaction.TransactionType
+	err = tx.QueryRowContext(ctx,
+		`SELECT name, quantity, type FROM transactions WHERE id = $1 AND org_id = $2 FOR UPDATE`,
+		ret.TransactionID, orgID).Scan(&ret.Name, &shipped, &txType)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("%w: original transaction", ErrNotFound)
+	} else if err != nil {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("failed to fetch original transaction: %w", err)
+	}
+
+	if txType != transaction.TypeOut {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("%w: returns must reference an EXIT transaction", ErrInvalid)
+	}
+
+	var productID uuid.UUID
+	var precision int
+	err = tx.QueryRowContext(ctx, `SELECT id, precision FROM stock WHERE org_id = $1 AND name = $2 AND deleted_at IS NULL FOR UPDATE`, orgID, ret.Name).Scan(&productID, &precision)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("%w: stock item %s", ErrNotFound, ret.Name)
+	} else if err != nil {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("failed to fetch product precision: %w", err)
+	}
+
+	for _, q := range []decimal.Decimal{ret.Quantity, ret.Restocked, ret.Scrapped, ret.Quarantined} {
+		if !stock.FitsPrecision(q, precision) {
+			tx.Rollback()
+			return uuid.Nil, fmt.Errorf("%w: quantity %s exceeds the product precision of %d decimal places", ErrInvalid, q, precision)
+		}
+	}
+
+	var alreadyReturned decimal.Decimal
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(quantity), 0) FROM returns WHERE transaction_id = $1`,
+		ret.TransactionID).Scan(&alreadyReturned)
+	if err != nil {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("failed to fetch returned quantity: %w", err)
+	}
+
+	if alreadyReturned.Add(ret.Quantity).GreaterThan(shipped) {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("%w: return quantity exceeds shipped quantity, %s of %s already returned", ErrInvalid, alreadyReturned, shipped)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO returns (id, org_id, transaction_id, name, quantity, restocked, scrapped, quarantined, reason, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		ret.ID, orgID, ret.TransactionID, ret.Name, ret.Quantity, ret.Restocked, ret.Scrapped, ret.Quarantined, ret.Reason, ret.CreatedBy)
+	if err != nil {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("failed to create return: %w", err)
+	}
+
+	var after []byte
+	err = tx.QueryRowContext(ctx, `SELECT to_jsonb(r) FROM returns r WHERE r.id = $1`, ret.ID).Scan(&after)
+	if err != nil {
+		tx.Rollback()
+		return uuid.Nil, fmt.Errorf("failed to snapshot return: %w", err)
+	}
+	err = recordAudit(ctx, tx, actor, audit.Entry{
+		OrgID:      uuid.NullUUID{UUID: orgID, Valid: true},
+		Action:     audit.ActionCreate,
+		EntityType: audit.EntityReturn,
+		EntityID:   ret.ID.String(),
+		After:      after,
+	})
+	if err != nil {
+		tx.Rollback()
+		return uuid.Nil, err
+	}
+
+	if ret.Restocked.IsPositive() {
+		err = applyStockMovement(ctx, tx, orgID, transaction.Transaction{
+			ID:          uuid.New(),
+			Name:        ret.Name,
+			Quantity:    ret.Restocked,
+			Type:        transaction.TypeReturn,
+			ReferenceID: uuid.NullUUID{UUID: ret.TransactionID, Valid: true},
+			CreatedBy:   ret.CreatedBy,
+		}, actor)
+		if err != nil {
+			tx.Rollback()
+			return uuid.Nil, err
+		}
+	}
+
+	if ret.Quarantined.IsPositive() {
+		before, err := snapshotProduct(ctx, tx, orgID, productID)
+		if err != nil {
+			tx.Rollback()
+			return uuid.Nil, err
+		}
+		_, err = tx.ExecContext(ctx,
+			`UPDATE stock SET quarantined_quantity = quarantined_quantity + $1, version = version + 1, updated_at = now(), updated_by = $3
+			WHERE id = $2`,
+			ret.Quarantined, productID, ret.CreatedBy)
+		if err != nil {
+			tx.Rollback()
+			return uuid.Nil, fmt.Errorf("failed to update quarantined quantity: %w", err)
+		}
+		if err := auditProduct(ctx, tx, orgID, actor, audit.ActionUpdate, productID, before); err != nil {
+			tx.Rollback()
+			return uuid.Nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return ret.ID, nil
+}
+
+func (r *returnRepo) GetAllReturns(ctx context.Context, orgID uuid.UUID) ([]rma.Return, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, transaction_id, name, quantity, restocked, scrapped, quarantined, reason, created_by, created_at FROM returns WHERE org_id = $1`, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all returns: %w", err)
+	}
+	defer rows.Close()
+
+	var returns []rma.Return
+	for rows.Next() {
+		var ret rma.Return
+		if err := rows.Scan(&ret.ID, &ret.TransactionID, &ret.Name, &ret.Quantity, &ret.Restocked, &ret.Scrapped, &ret.Quarantined, &ret.Reason, &ret.CreatedBy, &ret.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		returns = append(returns, ret)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return returns, nil
+}
@@ -1,20 +1,47 @@
 package repository
 
 import (
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/pricing"
 	"auth-register-sistem/internal/model/stock"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
 )
 
+// StockRepository manages the products of an organization; every method
+// only sees the products of orgID. Update, patch and delete only apply
+// when the stored version equals the given one and return
+// ErrVersionMismatch otherwise; a version of 0 skips the check.
+//
+// Deleting a product is a soft delete: the row is kept, hidden from
+// listings and rejected by new transactions until it is restored. Only
+// PurgeProductById removes the row.
+//
+// Every change is written to the audit log by actor, in the same
+// transaction, with snapshots of the product before and after it.
 type StockRepository interface {
-	CreateProduct(s stock.Stock) (uuid.UUID, error)
-	GetAllProducts() ([]stock.Stock, error)
-	UpdateProductById(s stock.Stock) (uuid.UUID, error)
-	DeleteProductById(id string) error
+	CreateProduct(ctx context.Context, orgID uuid.UUID, s stock.Stock, actor audit.Actor) (uuid.UUID, error)
+	GetAllProducts(ctx context.Context, orgID uuid.UUID, priceList string, includeDeleted bool) ([]stock.Stock, error)
+	GetProductById(ctx context.Context, orgID, id uuid.UUID, includeDeleted bool) (*stock.Stock, error)
+	UpdateProductById(ctx context.Context, orgID uuid.UUID, s stock.Stock, actor audit.Actor) (uuid.UUID, error)
+	PatchProductById(ctx context.Context, orgID uuid.UUID, s stock.Stock, actor audit.Actor) (uuid.UUID, error)
+	DeleteProductById(ctx context.Context, orgID, id uuid.UUID, version int, actor audit.Actor) error
+	RestoreProductById(ctx context.Context, orgID, id uuid.UUID, actor audit.Actor) error
+	ArchiveProductById(ctx context.Context, orgID, id uuid.UUID, actor audit.Actor) error
+	PurgeProductById(ctx context.Context, orgID, id uuid.UUID, actor audit.Actor) error
+	CreateVariants(ctx context.Context, orgID, parentID uuid.UUID, attributes map[string][]string, actor audit.Actor) ([]stock.Stock, error)
+	SetUnits(ctx context.Context, orgID, productID uuid.UUID, baseUnit string, units []stock.Unit, actor audit.Actor) error
+	GetUnits(ctx context.Context, orgID, productID uuid.UUID) ([]stock.Unit, error)
+	GetHistory(ctx context.Context, orgID, id uuid.UUID) ([]stock.Revision, error)
 }
 
 type stockRepo struct {
@@ -25,55 +52,856 @@ func NewStockRepository(db *sql.DB) StockRepository {
 	return &stockRepo{db: db}
 }
 
-func (r *stockRepo) CreateProduct(s stock.Stock) (uuid.UUID, error) {
+func (r *stockRepo) CreateProduct(ctx context.Context, orgID uuid.UUID, s stock.Stock, actor audit.Actor) (uuid.UUID, error) {
 	id := uuid.New()
 	s.ID = id
-	_, err := r.db.Exec(
-		`INSERT INTO stock (id, name, quantity, created_by)
-		VALUES ($1, $2, $3, $4)`,
-		id, s.Name, s.Quantity, s.CreatedBy)
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO stock (id, org_id, name, sku, base_unit, precision, quantity, currency, sale_price, cost_price, created_by, updated_by)
+		VALUES ($1, $2, $3, NULLIF($4, ''), COALESCE(NULLIF($5, ''), 'unit'), $6, $7, COALESCE(NULLIF($8, ''), 'BRL'), $9, $10, $11, $11)`,
+		id, orgID, s.Name, s.SKU, s.BaseUnit, s.Precision, s.Quantity, s.Currency, s.SalePrice, s.CostPrice, s.CreatedBy)
+	if err != nil {
+		tx.Rollback()
 		log.Println(err)
-		return uuid.UUID{}, fmt.Errorf("failed to create stock: %w", err)
+		return uuid.UUID{}, fmt.Errorf("failed to create stock: %w", uniqueViolation(err))
+	}
+
+	if err := auditProduct(ctx, tx, orgID, actor, audit.ActionCreate, id, nil); err != nil {
+		tx.Rollback()
+		return uuid.UUID{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 	return id, nil
 }
 
-func (r *stockRepo) GetAllProducts() ([]stock.Stock, error) {
-	rows, err := r.db.Query("SELECT id, name, quantity, created_by, created_at, updated_at FROM stock")
+// productColumns are the stock columns read by scanProduct, prefixed with
+// the table alias s.
+const productColumns = `s.id, s.name, COALESCE(s.sku, ''), s.parent_id, s.attributes, s.base_unit, s.precision,
+	s.quantity, s.quarantined_quantity, s.currency, s.sale_price, s.cost_price,
+	s.created_by, s.updated_by, s.created_at, s.updated_at, s.version, s.deleted_at, s.archived_at`
+
+// scanProduct scans productColumns followed by any extra columns.
+func scanProduct(rows *sql.Rows, extra ...interface{}) (stock.Stock, error) {
+	var s stock.Stock
+	var attributes []byte
+	dest := []interface{}{&s.ID, &s.Name, &s.SKU, &s.ParentID, &attributes, &s.BaseUnit, &s.Precision,
+		&s.Quantity, &s.QuarantinedQuantity, &s.Currency, &s.SalePrice, &s.CostPrice,
+		&s.CreatedBy, &s.UpdatedBy, &s.CreatedAt, &s.UpdatedAt, &s.Version, &s.DeletedAt, &s.ArchivedAt}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return s, fmt.Errorf("failed to scan row: %w", err)
+	}
+	if err := json.Unmarshal(attributes, &s.Attributes); err != nil {
+		return s, fmt.Errorf("failed to decode attributes: %w", err)
+	}
+	return s, nil
+}
+
+// GetAllProducts lists top-level products. Variants are nested under their
+// parent, whose quantities include the sum of its variants. Soft-deleted
+// products are left out unless includeDeleted is set.
+//
+// When priceList is set, each product carries the price from the currently
+// valid list of that name, or its sale price if it is not on the list.
+func (r *stockRepo) GetAllProducts(ctx context.Context, orgID uuid.UUID, priceList string, includeDeleted bool) ([]stock.Stock, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+productColumns+`, p.id, p.price, p.currency
+		FROM stock s
+		LEFT JOIN LATERAL (
+			SELECT l.id, i.price, l.currency
+			FROM price_lists l JOIN price_list_items i ON i.price_list_id = l.id
+			WHERE l.org_id = s.org_id AND l.name = $1 AND i.product_id = s.id
+				AND (l.valid_from IS NULL OR l.valid_from <= now())
+				AND (l.valid_to IS NULL OR l.valid_to > now())
+			ORDER BY l.valid_from DESC NULLS LAST
+			LIMIT 1
+		) p ON true
+		WHERE s.org_id = $3 AND ($2 OR s.deleted_at IS NULL)
+		ORDER BY s.name`, priceList, includeDeleted, orgID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get all products: %w", err)
 	}
 	defer rows.Close()
 
-	var stocks []stock.Stock
+	var all []stock.Stock
 	for rows.Next() {
-		var s stock.Stock
-		if err := rows.Scan(&s.ID, &s.Name, &s.Quantity, &s.CreatedBy, &s.CreatedAt, &s.UpdatedAt); err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
+		var listID uuid.NullUUID
+		var listPrice decimal.NullDecimal
+		var listCurrency sql.NullString
+		s, err := scanProduct(rows, &listID, &listPrice, &listCurrency)
+		if err != nil {
+			return nil, err
 		}
-		stocks = append(stocks, s)
+		if priceList != "" {
+			if listPrice.Valid {
+				s.Price = &pricing.Price{Amount: listPrice.Decimal, Currency: listCurrency.String, PriceListID: listID}
+			} else if s.SalePrice.Valid {
+				s.Price = &pricing.Price{Amount: s.SalePrice.Decimal, Currency: s.Currency}
+			}
+		}
+		all = append(all, s)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("failed to iterate rows: %w", err)
 	}
+
+	variants := make(map[uuid.UUID][]stock.Stock)
+	for _, s := range all {
+		if s.ParentID.Valid {
+			variants[s.ParentID.UUID] = append(variants[s.ParentID.UUID], s)
+		}
+	}
+
+	var stocks []stock.Stock
+	for _, s := range all {
+		if s.ParentID.Valid {
+			continue
+		}
+		s.Variants = variants[s.ID]
+		for _, v := range s.Variants {
+			if v.DeletedAt != nil {
+				continue
+			}
+			s.Quantity = s.Quantity.Add(v.Quantity)
+			s.QuarantinedQuantity = s.QuarantinedQuantity.Add(v.QuarantinedQuantity)
+		}
+		stocks = append(stocks, s)
+	}
 	return stocks, nil
 }
 
-func (r *stockRepo) UpdateProductById(s stock.Stock) (uuid.UUID, error) {
-	_, err := r.db.Exec(
-		`UPDATE stock SET name = $1, quantity = $2, updated_at = $3 WHERE id = $4`,
-		s.Name, s.Quantity, time.Now(), s.ID)
+// GetProductById returns a product with its variants, or ErrNotFound. A
+// soft-deleted product is only returned when includeDeleted is set.
+func (r *stockRepo) GetProductById(ctx context.Context, orgID, id uuid.UUID, includeDeleted bool) (*stock.Stock, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+productColumns+`
+		FROM stock s WHERE s.org_id = $3 AND (s.id = $1 OR s.parent_id = $1) AND ($2 OR s.deleted_at IS NULL)
+		ORDER BY s.parent_id NULLS FIRST, s.name`, id, includeDeleted, orgID)
 	if err != nil {
+		return nil, fmt.Errorf("failed to get product: %w", err)
+	}
+	defer rows.Close()
+
+	var product *stock.Stock
+	for rows.Next() {
+		s, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		if s.ID == id {
+			product = &s
+			continue
+		}
+		// Rows are ordered so the product itself comes before its variants
+		if product != nil {
+			product.Variants = append(product.Variants, s)
+			if s.DeletedAt == nil {
+				product.Quantity = product.Quantity.Add(s.Quantity)
+				product.QuarantinedQuantity = product.QuarantinedQuantity.Add(s.QuarantinedQuantity)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	if product == nil {
+		return nil, ErrNotFound
+	}
+	return product, nil
+}
+
+func (r *stockRepo) UpdateProductById(ctx context.Context, orgID uuid.UUID, s stock.Stock, actor audit.Actor) (uuid.UUID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	before, err := snapshotProduct(ctx, tx, orgID, s.ID)
+	if err != nil {
+		tx.Rollback()
+		return uuid.UUID{}, err
+	}
+
+	var precision, version int
+	var ownQuantity, variantQuantity decimal.Decimal
+	var hasVariants bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT precision, version, quantity,
+			EXISTS (SELECT 1 FROM stock v WHERE v.parent_id = stock.id AND v.deleted_at IS NULL),
+			COALESCE((SELECT SUM(v.quantity) FROM stock v WHERE v.parent_id = stock.id AND v.deleted_at IS NULL), 0)
+		FROM stock WHERE id = $1 AND org_id = $2 AND deleted_at IS NULL`,
+		s.ID, orgID).Scan(&precision, &version, &ownQuantity, &hasVariants, &variantQuantity)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return uuid.UUID{}, ErrNotFound
+	} else if err != nil {
+		tx.Rollback()
+		return uuid.UUID{}, fmt.Errorf("failed to fetch product precision: %w", err)
+	}
+	if s.Version != 0 && s.Version != version {
+		tx.Rollback()
+		return uuid.UUID{}, ErrVersionMismatch
+	}
+	// A parent is read with the quantity of its variants added in, so that
+	// total is accepted unchanged but only its own quantity is written back
+	if hasVariants {
+		if !s.Quantity.Equal(ownQuantity.Add(variantQuantity)) {
+			tx.Rollback()
+			return uuid.UUID{}, fmt.Errorf("%w: stock is held per variant, update the variant quantity instead", ErrInvalid)
+		}
+		s.Quantity = ownQuantity
+	}
+	if !stock.FitsPrecision(s.Quantity, precision) {
+		tx.Rollback()
+		return uuid.UUID{}, fmt.Errorf("%w: quantity exceeds the product precision of %d decimal places", ErrInvalid, precision)
+	}
+
+	// Prices are only changed when given. The row is locked, so the
+	// version cannot have moved since it was read.
+	_, err = tx.ExecContext(ctx,
+		`UPDATE stock SET name = $1, quantity = $2, sale_price = COALESCE($3, sale_price),
+			cost_price = COALESCE($4, cost_price), version = version + 1, updated_at = $5, updated_by = $9
+		WHERE id = $6 AND org_id = $7 AND version = $8 AND deleted_at IS NULL`,
+		s.Name, s.Quantity, s.SalePrice, s.CostPrice, time.Now(), s.ID, orgID, version, actor.UserID)
+	if err != nil {
+		tx.Rollback()
 		return uuid.UUID{}, fmt.Errorf("failed to update stock: %w", err)
 	}
+
+	if err := auditProduct(ctx, tx, orgID, actor, audit.ActionUpdate, s.ID, before); err != nil {
+		tx.Rollback()
+		return uuid.UUID{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return s.ID, nil
+}
+
+// PatchProductById writes every editable field of s, including clearing
+// prices, as the result of applying a merge patch to the stored product.
+func (r *stockRepo) PatchProductById(ctx context.Context, orgID uuid.UUID, s stock.Stock, actor audit.Actor) (uuid.UUID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	before, err := snapshotProduct(ctx, tx, orgID, s.ID)
+	if err != nil {
+		tx.Rollback()
+		return uuid.UUID{}, err
+	}
+
+	if err := checkBaseUnitChange(ctx, tx, orgID, s.ID, s.BaseUnit); err != nil {
+		tx.Rollback()
+		return uuid.UUID{}, err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE stock SET name = $1, sku = NULLIF($2, ''), base_unit = $3, precision = $4, quantity = $5,
+			currency = $6, sale_price = $7, cost_price = $8, version = version + 1, updated_at = $9, updated_by = $13
+		WHERE id = $10 AND org_id = $12 AND ($11 = 0 OR version = $11) AND deleted_at IS NULL`,
+		s.Name, s.SKU, s.BaseUnit, s.Precision, s.Quantity, s.Currency, s.SalePrice, s.CostPrice, time.Now(), s.ID, s.Version, orgID, actor.UserID)
+	if err != nil {
+		tx.Rollback()
+		return uuid.UUID{}, fmt.Errorf("failed to update stock: %w", uniqueViolation(err))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return uuid.UUID{}, r.missingOrStale(ctx, orgID, s.ID)
+	}
+
+	if err := auditProduct(ctx, tx, orgID, actor, audit.ActionUpdate, s.ID, before); err != nil {
+		tx.Rollback()
+		return uuid.UUID{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return s.ID, nil
 }
 
-func (r *stockRepo) DeleteProductById(id string) error {
-	_, err := r.db.Exec("DELETE FROM stock WHERE id = $1", id)
+// DeleteProductById soft-deletes a product together with its variants.
+func (r *stockRepo) DeleteProductById(ctx context.Context, orgID, id uuid.UUID, version int, actor audit.Actor) error {
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	before, err := snapshotProducts(ctx, tx, orgID, `(s.id = $2 OR s.parent_id = $2) AND s.deleted_at IS NULL`, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var deletedAt time.Time
+	err = tx.QueryRowContext(ctx,
+		`UPDATE stock SET deleted_at = now(), version = version + 1, updated_at = now(), updated_by = $4
+		WHERE id = $1 AND org_id = $3 AND ($2 = 0 OR version = $2) AND deleted_at IS NULL
+		RETURNING deleted_at`, id, version, orgID, actor.UserID).Scan(&deletedAt)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return r.missingOrStale(ctx, orgID, id)
+	} else if err != nil {
+		tx.Rollback()
 		return fmt.Errorf("failed to delete stock: %w", err)
 	}
+
+	// Variants share the parent's deletion time so restoring the parent
+	// brings back exactly the variants deleted with it
+	_, err = tx.ExecContext(ctx,
+		`UPDATE stock SET deleted_at = $1, version = version + 1, updated_at = now(), updated_by = $3
+		WHERE parent_id = $2 AND deleted_at IS NULL`, deletedAt, id, actor.UserID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete variants: %w", err)
+	}
+
+	if err := auditProducts(ctx, tx, orgID, actor, audit.ActionDelete, before); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return nil
 }
+
+// RestoreProductById undoes a soft delete, including the archived flag and
+// the variants that were deleted along with the product.
+func (r *stockRepo) RestoreProductById(ctx context.Context, orgID, id uuid.UUID, actor audit.Actor) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	restoring := `s.deleted_at IS NOT NULL
+		AND (s.id = $2 OR s.parent_id = $2 AND s.deleted_at = (SELECT deleted_at FROM stock WHERE id = $2))`
+	before, err := snapshotProducts(ctx, tx, orgID, restoring, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if len(before) == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE stock s SET deleted_at = NULL, archived_at = NULL, version = version + 1, updated_at = now(), updated_by = $3
+		WHERE s.org_id = $1 AND `+restoring, orgID, id, actor.UserID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to restore stock: %w", err)
+	}
+
+	if err := auditProducts(ctx, tx, orgID, actor, audit.ActionRestore, before); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ArchiveProductById marks a soft-deleted product as archived, which
+// allows purging it even though it has ledger history.
+func (r *stockRepo) ArchiveProductById(ctx context.Context, orgID, id uuid.UUID, actor audit.Actor) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	before, err := snapshotProduct(ctx, tx, orgID, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE stock SET archived_at = now(), version = version + 1, updated_at = now(), updated_by = $3
+		WHERE id = $1 AND org_id = $2 AND deleted_at IS NOT NULL AND archived_at IS NULL`, id, orgID, actor.UserID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to archive stock: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+
+	if err := auditProduct(ctx, tx, orgID, actor, audit.ActionArchive, id, before); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// PurgeProductById permanently removes a soft-deleted product. Products
+// with ledger history must be archived first, and products still used as
+// a variant parent or in kits cannot be purged. Ledger entries are kept.
+func (r *stockRepo) PurgeProductById(ctx context.Context, orgID, id uuid.UUID, actor audit.Actor) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	before, err := snapshotProduct(ctx, tx, orgID, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var archived, hasHistory, inUse bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT s.archived_at IS NOT NULL,
+			EXISTS (SELECT 1 FROM transactions t WHERE t.org_id = s.org_id AND t.name = s.name),
+			EXISTS (SELECT 1 FROM stock v WHERE v.parent_id = s.id)
+				OR EXISTS (SELECT 1 FROM bom_components b WHERE b.component_id = s.id)
+				OR EXISTS (SELECT 1 FROM kit_operations k WHERE k.kit_id = s.id)
+		FROM stock s WHERE s.id = $1 AND s.org_id = $2 AND s.deleted_at IS NOT NULL FOR UPDATE`,
+		id, orgID).Scan(&archived, &hasHistory, &inUse)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return ErrNotFound
+	} else if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to check product: %w", err)
+	}
+
+	if hasHistory && !archived {
+		tx.Rollback()
+		return fmt.Errorf("%w: product has ledger history, archive it before purging", ErrConflict)
+	}
+	if inUse {
+		tx.Rollback()
+		return fmt.Errorf("%w: product has variants or is used in a kit", ErrConflict)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM stock WHERE id = $1`, id)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to purge stock: %w", err)
+	}
+
+	if err := auditProduct(ctx, tx, orgID, actor, audit.ActionPurge, id, before); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// missingOrStale tells apart the two reasons a versioned write on product
+// id can match no rows. Soft-deleted products count as missing.
+func (r *stockRepo) missingOrStale(ctx context.Context, orgID, id uuid.UUID) error {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM stock WHERE id = $1 AND org_id = $2 AND deleted_at IS NULL)`, id, orgID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check product: %w", err)
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return ErrVersionMismatch
+}
+
+// productSnapshot is the JSON state of a product, as written to the audit
+// log
+type productSnapshot struct {
+	id   uuid.UUID
+	data []byte
+}
+
+// snapshotProducts returns the products of orgID matching cond, where $1
+// is orgID and args follow from $2, with their units. The rows stay locked
+// for the rest of tx.
+func snapshotProducts(ctx context.Context, tx *sql.Tx, orgID uuid.UUID, cond string, args ...interface{}) ([]productSnapshot, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT s.id, to_jsonb(s) || jsonb_build_object('units', COALESCE((
+			SELECT jsonb_agg(jsonb_build_object('name', u.name, 'factor', u.factor) ORDER BY u.factor)
+			FROM product_units u WHERE u.product_id = s.id), '[]'::jsonb))
+		FROM stock s WHERE s.org_id = $1 AND (`+cond+`)
+		ORDER BY s.parent_id NULLS FIRST, s.name
+		FOR UPDATE`, append([]interface{}{orgID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot products: %w", err)
+	}
+	defer rows.Close()
+
+	var snapshots []productSnapshot
+	for rows.Next() {
+		var snap productSnapshot
+		if err := rows.Scan(&snap.id, &snap.data); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		snapshots = append(snapshots, snap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return snapshots, nil
+}
+
+// snapshotProduct is snapshotProducts for a single product. It returns nil
+// when the product does not exist.
+func snapshotProduct(ctx context.Context, tx *sql.Tx, orgID, id uuid.UUID) ([]byte, error) {
+	snapshots, err := snapshotProducts(ctx, tx, orgID, `s.id = $2`, id)
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+	return snapshots[0].data, nil
+}
+
+// auditProduct records a change of product id, comparing before with the
+// state of the product now
+func auditProduct(ctx context.Context, tx *sql.Tx, orgID uuid.UUID, actor audit.Actor, action string, id uuid.UUID, before []byte) error {
+	after, err := snapshotProduct(ctx, tx, orgID, id)
+	if err != nil {
+		return err
+	}
+	return recordAudit(ctx, tx, actor, audit.Entry{
+		OrgID:      uuid.NullUUID{UUID: orgID, Valid: true},
+		Action:     action,
+		EntityType: audit.EntityStock,
+		EntityID:   id.String(),
+		Before:     before,
+		After:      after,
+	})
+}
+
+// auditProducts is auditProduct for every snapshot in before
+func auditProducts(ctx context.Context, tx *sql.Tx, orgID uuid.UUID, actor audit.Actor, action string, before []productSnapshot) error {
+	for _, snap := range before {
+		if err := auditProduct(ctx, tx, orgID, actor, action, snap.id, snap.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateVariants generates one variant per combination of the given
+// attribute values (e.g. every size for every color). Variant SKUs are the
+// parent SKU followed by the attribute values; combinations that already
+// exist as variants of the parent are skipped so the call can be repeated
+// to extend the matrix. Combinations whose SKUs collide with each other
+// return ErrInvalid, and with another product ErrConflict.
+func (r *stockRepo) CreateVariants(ctx context.Context, orgID, parentID uuid.UUID, attributes map[string][]string, actor audit.Actor) ([]stock.Stock, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	// Variants are counted and priced like their parent
+	var parent stock.Stock
+	var grandParent uuid.NullUUID
+	err = tx.QueryRowContext(ctx,
+		`SELECT name, COALESCE(sku, ''), parent_id, base_unit, precision, currency, sale_price, cost_price
+		FROM stock WHERE id = $1 AND org_id = $2 AND deleted_at IS NULL FOR UPDATE`,
+		parentID, orgID).Scan(&parent.Name, &parent.SKU, &grandParent, &parent.BaseUnit, &parent.Precision, &parent.Currency, &parent.SalePrice, &parent.CostPrice)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, fmt.Errorf("%w: product %s", ErrNotFound, parentID)
+	} else if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to fetch parent product: %w", err)
+	}
+
+	if grandParent.Valid {
+		tx.Rollback()
+		return nil, fmt.Errorf("%w: a variant cannot have variants", ErrInvalid)
+	}
+
+	if parent.SKU == "" {
+		parent.SKU = skuPart(parent.Name)
+	}
+
+	// seen maps the SKUs generated so far to their variant names, since
+	// values differing only in skipped characters share a SKU
+	seen := map[string]string{}
+	var created []stock.Stock
+	for _, combo := range attributeCombinations(attributes) {
+		v := stock.Stock{
+			ID:         uuid.New(),
+			Name:       parent.Name + " - " + strings.Join(combo.values, " / "),
+			SKU:        parent.SKU,
+			ParentID:   uuid.NullUUID{UUID: parentID, Valid: true},
+			Attributes: combo.attributes,
+			BaseUnit:   parent.BaseUnit,
+			Precision:  parent.Precision,
+			Currency:   parent.Currency,
+			SalePrice:  parent.SalePrice,
+			CostPrice:  parent.CostPrice,
+			CreatedBy:  actor.UserID,
+		}
+		for _, value := range combo.values {
+			part := skuPart(value)
+			if part == "" {
+				tx.Rollback()
+				return nil, fmt.Errorf("%w: attribute value %q has no letters or digits for the SKU", ErrInvalid, value)
+			}
+			v.SKU += "-" + part
+		}
+		if other, ok := seen[v.SKU]; ok {
+			tx.Rollback()
+			return nil, fmt.Errorf("%w: variants %q and %q would both get SKU %s", ErrInvalid, other, v.Name, v.SKU)
+		}
+		seen[v.SKU] = v.Name
+
+		encoded, err := json.Marshal(v.Attributes)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to encode attributes: %w", err)
+		}
+
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO stock (id, org_id, name, sku, parent_id, attributes, quantity,
+				base_unit, precision, currency, sale_price, cost_price, created_by, updated_by)
+			VALUES ($1, $2, $3, $4, $5, $6, 0, $7, $8, $9, $10, $11, $12, $12)
+			ON CONFLICT (org_id, sku) DO NOTHING`,
+			v.ID, orgID, v.Name, v.SKU, v.ParentID, string(encoded),
+			v.BaseUnit, v.Precision, v.Currency, v.SalePrice, v.CostPrice, v.CreatedBy)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to create variant %s: %w", v.SKU, uniqueViolation(err))
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			created = append(created, v)
+			continue
+		}
+
+		// Only the same variant of this parent may already hold the SKU
+		var same bool
+		err = tx.QueryRowContext(ctx,
+			`SELECT parent_id IS NOT DISTINCT FROM $3 AND attributes = $4::jsonb FROM stock WHERE org_id = $1 AND sku = $2`,
+			orgID, v.SKU, parentID, string(encoded)).Scan(&same)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to check SKU %s: %w", v.SKU, err)
+		}
+		if !same {
+			tx.Rollback()
+			return nil, fmt.Errorf("%w: SKU %s of variant %q is taken by another product", ErrConflict, v.SKU, v.Name)
+		}
+	}
+
+	for _, v := range created {
+		if err := auditProduct(ctx, tx, orgID, actor, audit.ActionCreate, v.ID, nil); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return created, nil
+}
+
+// checkBaseUnitChange returns ErrConflict when baseUnit differs from the
+// base unit of product id while it holds stock or has transactions. Their
+// quantities are stored in the base unit, so changing it would silently
+// reinterpret them.
+func checkBaseUnitChange(ctx context.Context, tx *sql.Tx, orgID, id uuid.UUID, baseUnit string) error {
+	var currentUnit string
+	var inUse bool
+	err := tx.QueryRowContext(ctx,
+		`SELECT base_unit, quantity <> 0 OR quarantined_quantity <> 0
+			OR EXISTS (SELECT 1 FROM transactions t WHERE t.org_id = stock.org_id AND t.name = stock.name)
+		FROM stock WHERE id = $1 AND org_id = $2 AND deleted_at IS NULL`,
+		id, orgID).Scan(&currentUnit, &inUse)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to fetch base unit: %w", err)
+	}
+	if baseUnit != currentUnit && inUse {
+		return fmt.Errorf("%w: the base unit of a product with stock or transactions cannot change", ErrConflict)
+	}
+	return nil
+}
+
+// SetUnits sets the base unit of a product and replaces its alternative
+// units. The base unit only changes while the product has no stock and no
+// transactions.
+func (r *stockRepo) SetUnits(ctx context.Context, orgID, productID uuid.UUID, baseUnit string, units []stock.Unit, actor audit.Actor) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	before, err := snapshotProduct(ctx, tx, orgID, productID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := checkBaseUnitChange(ctx, tx, orgID, productID, baseUnit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE stock SET base_unit = $1, version = version + 1, updated_at = now(), updated_by = $3
+		WHERE id = $2`, baseUnit, productID, actor.UserID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update base unit: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM product_units WHERE product_id = $1`, productID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to clear units: %w", err)
+	}
+
+	for _, u := range units {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO product_units (product_id, name, factor) VALUES ($1, $2, $3)`,
+			productID, u.Name, u.Factor)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to add unit %s: %w", u.Name, uniqueViolation(err))
+		}
+	}
+
+	if err := auditProduct(ctx, tx, orgID, actor, audit.ActionSetUnits, productID, before); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *stockRepo) GetUnits(ctx context.Context, orgID, productID uuid.UUID) ([]stock.Unit, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT u.name, u.factor FROM product_units u JOIN stock s ON s.id = u.product_id
+		WHERE u.product_id = $1 AND s.org_id = $2 ORDER BY u.factor`, productID, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get units: %w", err)
+	}
+	defer rows.Close()
+
+	var units []stock.Unit
+	for rows.Next() {
+		var u stock.Unit
+		if err := rows.Scan(&u.Name, &u.Factor); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		units = append(units, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return units, nil
+}
+
+// GetHistory returns every version of a product, newest first, including
+// the current one. Deleted products keep their history until purged.
+func (r *stockRepo) GetHistory(ctx context.Context, orgID, id uuid.UUID) ([]stock.Revision, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT h.version, h.updated_by, h.updated_at, h.data
+		FROM product_history h JOIN stock s ON s.id = h.product_id
+		WHERE h.product_id = $1 AND s.org_id = $2
+		UNION ALL
+		SELECT s.version, s.updated_by, s.updated_at, to_jsonb(s)
+		FROM stock s WHERE s.id = $1 AND s.org_id = $2
+		ORDER BY 1 DESC`, id, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get product history: %w", err)
+	}
+	defer rows.Close()
+
+	var revisions []stock.Revision
+	for rows.Next() {
+		var rev stock.Revision
+		var data []byte
+		if err := rows.Scan(&rev.Version, &rev.UpdatedBy, &rev.UpdatedAt, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		rev.Product = data
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	if len(revisions) == 0 {
+		return nil, ErrNotFound
+	}
+	return revisions, nil
+}
+
+type attributeCombination struct {
+	attributes map[string]string
+	values     []string
+}
+
+// attributeCombinations returns the cartesian product of the attribute
+// values, with attribute names in alphabetical order.
+func attributeCombinations(attributes map[string][]string) []attributeCombination {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combos := []attributeCombination{{attributes: map[string]string{}}}
+	for _, name := range names {
+		var next []attributeCombination
+		for _, c := range combos {
+			for _, value := range attributes[name] {
+				attrs := make(map[string]string, len(c.attributes)+1)
+				for k, v := range c.attributes {
+					attrs[k] = v
+				}
+				attrs[name] = value
+				values := append(append([]string{}, c.values...), value)
+				next = append(next, attributeCombination{attributes: attrs, values: values})
+			}
+		}
+		combos = next
+	}
+	return combos
+}
+
+// skuPart upper-cases s and keeps only letters and digits.
+func skuPart(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/user"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TokenRepository issues and redeems the single-use tokens sent by email.
+// Only a SHA-256 hash of each token is stored. Redeeming a token is written
+// to the audit log in the same transaction, as made by actor or, for an
+// anonymous actor, by the token's user.
+type TokenRepository interface {
+	CreateToken(ctx context.Context, userID uuid.UUID, purpose string, ttl time.Duration) (string, error)
+	ResetPassword(ctx context.Context, token, passwordHash string, actor audit.Actor) (uuid.UUID, error)
+	VerifyEmail(ctx context.Context, token string, actor audit.Actor) (uuid.UUID, error)
+}
+
+type tokenRepo struct {
+	db *sql.DB
+}
+
+func NewTokenRepository(db *sql.DB) TokenRepository {
+	return &tokenRepo{db: db}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken returns a new token for userID, invalidating any earlier
+// unused token with the same purpose.
+func (r *tokenRepo) CreateToken(ctx context.Context, userID uuid.UUID, purpose string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE user_tokens SET used_at = now() WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL`,
+		userID, purpose)
+	if err != nil {
+		return "", fmt.Errorf("failed to invalidate tokens: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, purpose, hashToken(token), time.Now().Add(ttl))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return token, nil
+}
+
+// consumeToken marks a valid token as used and returns its user. It returns
+// ErrNotFound for unknown, expired or already used tokens.
+func consumeToken(ctx context.Context, tx *sql.Tx, token, purpose string) (uuid.UUID, error) {
+	var userID uuid.UUID
+	err := tx.QueryRowContext(ctx,
+		`UPDATE user_tokens SET used_at = now()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id`,
+		hashToken(token), purpose).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, ErrNotFound
+	} else if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to consume token: %w", err)
+	}
+	return userID, nil
+}
+
+// tokenActor attributes a change made with a token to the token's user when
+// the request carried no other identity
+func tokenActor(actor audit.Actor, userID uuid.UUID) audit.Actor {
+	if !actor.UserID.Valid && !actor.APIKeyID.Valid {
+		actor.UserID = uuid.NullUUID{UUID: userID, Valid: true}
+	}
+	return actor
+}
+
+// ResetPassword redeems a password reset token and sets the new password
+// hash. Since the link was delivered to the account's email, this also
+// verifies it.
+func (r *tokenRepo) ResetPassword(ctx context.Context, token, passwordHash string, actor audit.Actor) (uuid.UUID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeToken(ctx, tx, token, user.PurposePasswordReset)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	before, err := snapshotUser(ctx, tx, userID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE users SET password = $1, email_verified_at = COALESCE(email_verified_at, now()), updated_at = now()
+		WHERE id = $2`,
+		passwordHash, userID)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to update password: %w", err)
+	}
+
+	if err := auditUser(ctx, tx, tokenActor(actor, userID), audit.ActionResetPassword, userID, before); err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return userID, nil
+}
+
+// VerifyEmail redeems an email verification token.
+func (r *tokenRepo) VerifyEmail(ctx context.Context, token string, actor audit.Actor) (uuid.UUID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeToken(ctx, tx, token, user.PurposeEmailVerification)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	before, err := snapshotUser(ctx, tx, userID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE users SET email_verified_at = COALESCE(email_verified_at, now()), updated_at = now() WHERE id = $1`,
+		userID)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	if err := auditUser(ctx, tx, tokenActor(actor, userID), audit.ActionVerifyEmail, userID, before); err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return userID, nil
+}
@@ -1,15 +1,23 @@
 package repository
 
 import (
+	"auth-register-sistem/internal/model/audit"
+	"auth-register-sistem/internal/model/stock"
 	"auth-register-sistem/internal/model/transaction"
+	"context"
 	"database/sql"
 	"fmt"
+
 	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
 )
 
+// TransactionRepository books stock movements in the ledger of an
+// organization. Each booking is written to the audit log by actor in the
+// same transaction.
 type TransactionRepository interface {
-	CreateTransaction(t transaction.Transaction) (uuid.UUID, error)
-	GetAllTransactions() ([]transaction.Transaction, error)
+	CreateTransaction(ctx context.Context, orgID uuid.UUID, t transaction.Transaction, actor audit.Actor) (uuid.UUID, error)
+	GetAllTransactions(ctx context.Context, orgID uuid.UUID) ([]transaction.Transaction, error)
 }
 
 type TransactionRepo struct {
@@ -20,70 +28,153 @@ func NewTransactionRepository(db *sql.DB) TransactionRepository {
 	return &TransactionRepo{db: db}
 }
 
-func (r *TransactionRepo) CreateTransaction(t transaction.Transaction) (uuid.UUID, error) {
-	id := uuid.New()
-	t.ID = id
+func (r *TransactionRepo) CreateTransaction(ctx context.Context, orgID uuid.UUID, t transaction.Transaction, actor audit.Actor) (uuid.UUID, error) {
+	t.ID = uuid.New()
 
-	tx, err := r.db.Begin()
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
-	_, err = tx.Exec(
-		`INSERT INTO transactions (id, name, quantity, type, created_by)
-		VALUES ($1, $2, $3, $4, $5)`,
-		id, t.Name, t.Quantity, t.Type, t.CreatedBy)
-	if err != nil {
+	if err := applyStockMovement(ctx, tx, orgID, t, actor); err != nil {
 		tx.Rollback()
-		return uuid.Nil, fmt.Errorf("failed to create transaction: %w", err)
+		return uuid.Nil, err
 	}
 
-	var currentQty int
-	err = tx.QueryRow(
-		`SELECT quantity FROM stock WHERE name = $1 FOR UPDATE`,
-		t.Name).Scan(&currentQty)
+	err = tx.Commit()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return t.ID, nil
+}
+
+// applyStockMovement records t in the ledger of orgID and adjusts the
+// matching stock row of that organization inside tx. The stock row is
+// locked with FOR UPDATE so concurrent movements on the same product are
+// serialized. The ledger row and the stock change are written to the audit
+// log by actor, so every path that moves stock is audited. The ledger row
+// keeps the product id and the currency of the product, so reports do not
+// depend on names.
+//
+// When t.Unit is set, t.UnitQuantity is converted to the product's base unit
+// to obtain t.Quantity; otherwise t.Quantity is taken to be in the base unit.
+// Without an explicit t.UnitPrice, the product's current cost price (ENTRY)
+// or sale price (EXIT) is recorded.
+func applyStockMovement(ctx context.Context, tx *sql.Tx, orgID uuid.UUID, t transaction.Transaction, actor audit.Actor) error {
+	var productID uuid.UUID
+	var currentQty decimal.Decimal
+	var baseUnit, currency string
+	var precision int
+	var salePrice, costPrice decimal.NullDecimal
+	var hasVariants, deleted bool
+	err := tx.QueryRowContext(ctx,
+		`SELECT id, quantity, base_unit, precision, currency, sale_price, cost_price,
+			EXISTS (SELECT 1 FROM stock v WHERE v.parent_id = stock.id AND v.deleted_at IS NULL),
+			deleted_at IS NOT NULL
+		FROM stock WHERE org_id = $2 AND name = $1
+		ORDER BY deleted_at NULLS FIRST
+		LIMIT 1
+		FOR UPDATE`,
+		t.Name, orgID).Scan(&productID, &currentQty, &baseUnit, &precision, &currency, &salePrice, &costPrice, &hasVariants, &deleted)
 
 	if err == sql.ErrNoRows {
-		tx.Rollback()
-		return uuid.Nil, fmt.Errorf("stock item not found")
+		return fmt.Errorf("%w: stock item %s", ErrNotFound, t.Name)
 	} else if err != nil {
-		tx.Rollback()
-		return uuid.Nil, fmt.Errorf("failed to fetch current stock quantity: %w", err)
+		return fmt.Errorf("failed to fetch current stock quantity: %w", err)
+	}
+
+	if deleted {
+		return fmt.Errorf("%w: stock item %s is deleted", ErrConflict, t.Name)
+	}
+
+	// Products with variants hold no stock of their own
+	if hasVariants {
+		return fmt.Errorf("%w: stock is held per variant, use a variant name", ErrInvalid)
+	}
+
+	switch t.Unit {
+	case "":
+		t.Unit = baseUnit
+		t.UnitQuantity = t.Quantity
+	case baseUnit:
+		t.Quantity = t.UnitQuantity
+	default:
+		var factor decimal.Decimal
+		err = tx.QueryRowContext(ctx,
+			`SELECT factor FROM product_units WHERE product_id = $1 AND name = $2`,
+			productID, t.Unit).Scan(&factor)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: unknown unit %q for %s", ErrInvalid, t.Unit, t.Name)
+		} else if err != nil {
+			return fmt.Errorf("failed to fetch unit conversion: %w", err)
+		}
+		t.Quantity = t.UnitQuantity.Mul(factor)
+	}
+
+	before, err := snapshotProduct(ctx, tx, orgID, productID)
+	if err != nil {
+		return err
 	}
 
-	newQty := currentQty
+	if !stock.FitsPrecision(t.Quantity, precision) {
+		return fmt.Errorf("%w: quantity %s of %s exceeds the product precision of %d decimal places", ErrInvalid, t.Quantity, t.Name, precision)
+	}
+
+	var newQty decimal.Decimal
 	switch t.Type {
-	case "ENTRY":
-		newQty += t.Quantity
-	case "EXIT":
-		if t.Quantity > currentQty {
-			tx.Rollback()
-			return uuid.Nil, fmt.Errorf("insufficient stock for EXIT transaction")
+	case transaction.TypeIn, transaction.TypeReturn:
+		newQty = currentQty.Add(t.Quantity)
+		if t.Type == transaction.TypeIn && !t.UnitPrice.Valid {
+			t.UnitPrice = costPrice
+		}
+	case transaction.TypeOut:
+		if !t.UnitPrice.Valid {
+			t.UnitPrice = salePrice
+		}
+		if t.Quantity.GreaterThan(currentQty) {
+			return &InsufficientStockError{Product: t.Name, Available: currentQty, Requested: t.Quantity}
 		}
-		newQty -= t.Quantity
+		newQty = currentQty.Sub(t.Quantity)
 	default:
-		tx.Rollback()
-		return uuid.Nil, fmt.Errorf("invalid transaction type: %s", t.Type)
+		return fmt.Errorf("%w: transaction type %s", ErrInvalid, t.Type)
 	}
 
-	_, err = tx.Exec(
-		`UPDATE stock SET quantity = $1, updated_at = now() WHERE name = $2`,
-		newQty, t.Name)
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO transactions (id, org_id, product_id, name, quantity, unit, unit_quantity, unit_price, currency, type, reference_id, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		t.ID, orgID, productID, t.Name, t.Quantity, t.Unit, t.UnitQuantity, t.UnitPrice, currency, t.Type, t.ReferenceID, t.CreatedBy)
 	if err != nil {
-		tx.Rollback()
-		return uuid.Nil, fmt.Errorf("failed to update stock quantity: %w", err)
+		return fmt.Errorf("failed to create transaction: %w", err)
 	}
 
-	err = tx.Commit()
+	_, err = tx.ExecContext(ctx,
+		`UPDATE stock SET quantity = $1, version = version + 1, updated_at = now(), updated_by = $3 WHERE id = $2`,
+		newQty, productID, t.CreatedBy)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+		return fmt.Errorf("failed to update stock quantity: %w", err)
 	}
 
-	return t.ID, nil
+	var after []byte
+	err = tx.QueryRowContext(ctx, `SELECT to_jsonb(t) FROM transactions t WHERE t.id = $1`, t.ID).Scan(&after)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot transaction: %w", err)
+	}
+	err = recordAudit(ctx, tx, actor, audit.Entry{
+		OrgID:      uuid.NullUUID{UUID: orgID, Valid: true},
+		Action:     audit.ActionCreate,
+		EntityType: audit.EntityTransaction,
+		EntityID:   t.ID.String(),
+		After:      after,
+	})
+	if err != nil {
+		return err
+	}
+	return auditProduct(ctx, tx, orgID, actor, audit.ActionUpdate, productID, before)
 }
 
-func (r *TransactionRepo) GetAllTransactions() ([]transaction.Transaction, error) {
-	rows, err := r.db.Query("SELECT id, name, quantity, type, created_by, created_at, updated_at FROM transactions")
+func (r *TransactionRepo) GetAllTransactions(ctx context.Context, orgID uuid.UUID) ([]transaction.Transaction, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT id, name, quantity, unit, COALESCE(unit_quantity, quantity), unit_price, type, reference_id, created_by, created_at, updated_at FROM transactions WHERE org_id = $1", orgID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get all transactions: %w", err)
 	}
@@ -92,7 +183,7 @@ func (r *TransactionRepo) GetAllTransactions() ([]transaction.Transaction, error
 	var transactions []transaction.Transaction
 	for rows.Next() {
 		var t transaction.Transaction
-		if err := rows.Scan(&t.ID, &t.Name, &t.Quantity, &t.Type, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		if err := rows.Scan(&t.ID, &t.Name, &t.Quantity, &t.Unit, &t.UnitQuantity, &t.UnitPrice, &t.Type, &t.ReferenceID, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 		transactions = append(transactions, t)
@@ -1,18 +1,32 @@
 package repository
 
 import (
+	"auth-register-sistem/internal/model/audit"
 	"auth-register-sistem/internal/model/user"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// UserRepository stores accounts. Changes made through account management
+// are written to the audit log by actor in the same transaction; login
+// bookkeeping is not.
 type UserRepository interface {
-	Create(user user.User) (uuid.UUID, error)
-	FindByEmail(email string) (*user.User, error)
-	FindByUsername(username string) (*user.User, error)
+	Create(ctx context.Context, user user.User, actor audit.Actor) (uuid.UUID, error)
+	FindByEmail(ctx context.Context, email string) (*user.User, error)
+	FindByUsername(ctx context.Context, username string) (*user.User, error)
+	FindByID(ctx context.Context, id uuid.UUID) (*user.User, error)
+	List(ctx context.Context) ([]user.User, error)
+	Update(ctx context.Context, u user.User, actor audit.Actor) error
+	SetDisabled(ctx context.Context, id uuid.UUID, disabled bool, actor audit.Actor) error
+	Unlock(ctx context.Context, id uuid.UUID, actor audit.Actor) error
+	PromoteAdmin(ctx context.Context, email string, actor audit.Actor) error
+	RegisterFailedLogin(ctx context.Context, id uuid.UUID, maxFailures int, lockout time.Duration) error
+	ResetFailedLogins(ctx context.Context, id uuid.UUID) error
 }
 
 type userRepo struct {
@@ -23,42 +37,238 @@ func NewUserRepository(db *sql.DB) UserRepository {
 	return &userRepo{db: db}
 }
 
-func (r *userRepo) Create(u user.User) (uuid.UUID, error) {
+const userColumns = `id, name, username, email, password, role, disabled_at, email_verified_at,
+	failed_logins, locked_until, COALESCE(locked_until > now(), false), mfa_enabled_at, created_at, updated_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*user.User, error) {
+	u := &user.User{}
+	err := row.Scan(&u.ID, &u.Name, &u.Username, &u.Email, &u.Password, &u.Role, &u.DisabledAt, &u.EmailVerifiedAt, &u.FailedLogins, &u.LockedUntil, &u.Locked, &u.MFAEnabledAt, &u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Create inserts a user with the user role. Admins are named by
+// configuration, see PromoteAdmin.
+func (r *userRepo) Create(ctx context.Context, u user.User, actor audit.Actor) (uuid.UUID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
 	id := uuid.New()
-	_, err := r.db.Exec(
-		"INSERT INTO users (id, name, username, email, password) VALUES ($1, $2, $3, $4, $5)",
-		id, u.Name, u.Username, u.Email, u.Password,
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO users (id, name, username, email, password, role)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		id, u.Name, u.Username, u.Email, u.Password, user.RoleUser,
 	)
 
 	if err != nil {
-		return uuid.UUID{}, fmt.Errorf("failed to create user: %w", err)
+		return uuid.UUID{}, fmt.Errorf("failed to create user: %w", uniqueViolation(err))
+	}
+
+	if err := auditUser(ctx, tx, actor, audit.ActionCreate, id, nil); err != nil {
+		return uuid.UUID{}, err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return id, nil
 }
 
-func (r *userRepo) FindByEmail(email string) (*user.User, error) {
-	row := r.db.QueryRow("SELECT id, name, username, email, password FROM users WHERE email = $1", email)
-	u := &user.User{}
-	err := row.Scan(&u.ID, &u.Name, &u.Username, &u.Email, &u.Password)
+func (r *userRepo) FindByEmail(ctx context.Context, email string) (*user.User, error) {
+	u, err := scanUser(r.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE email = $1", email))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil // user not found
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
 	return u, nil
 }
 
-func (r *userRepo) FindByUsername(username string) (*user.User, error) {
-	row := r.db.QueryRow("SELECT id, name, username, email, password FROM users WHERE username = $1", username)
-	u := &user.User{}
-	err := row.Scan(&u.ID, &u.Name, &u.Username, &u.Email, &u.Password)
+func (r *userRepo) FindByUsername(ctx context.Context, username string) (*user.User, error) {
+	u, err := scanUser(r.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE username = $1", username))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+func (r *userRepo) FindByID(ctx context.Context, id uuid.UUID) (*user.User, error) {
+	u, err := scanUser(r.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1", id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil // user not found
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
 	return u, nil
 }
+
+func (r *userRepo) List(ctx context.Context) ([]user.User, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+userColumns+" FROM users ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []user.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		users = append(users, *u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rows: %w", err)
+	}
+	return users, nil
+}
+
+// Update saves the editable profile fields of u: name, email and role.
+// Changing the email clears its verification.
+func (r *userRepo) Update(ctx context.Context, u user.User, actor audit.Actor) error {
+	return changeUser(ctx, r.db, u.ID, actor, audit.ActionUpdate,
+		`UPDATE users SET name = $2, email = $3, role = $4,
+			email_verified_at = CASE WHEN email = $3 THEN email_verified_at END,
+			updated_at = now()
+		WHERE id = $1`,
+		u.Name, u.Email, u.Role)
+}
+
+func (r *userRepo) SetDisabled(ctx context.Context, id uuid.UUID, disabled bool, actor audit.Actor) error {
+	action := audit.ActionEnable
+	if disabled {
+		action = audit.ActionDisable
+	}
+	return changeUser(ctx, r.db, id, actor, action,
+		`UPDATE users SET disabled_at = CASE WHEN $2 THEN COALESCE(disabled_at, now()) END, updated_at = now() WHERE id = $1`,
+		disabled)
+}
+
+// Unlock is ResetFailedLogins done by an admin, and so audited
+func (r *userRepo) Unlock(ctx context.Context, id uuid.UUID, actor audit.Actor) error {
+	return changeUser(ctx, r.db, id, actor, audit.ActionUnlock,
+		`UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = $1`)
+}
+
+// PromoteAdmin gives the admin role to the account whose verified email
+// address is email. It returns ErrNotFound while there is none, so the role
+// never goes to whoever registers the address first without owning it.
+func (r *userRepo) PromoteAdmin(ctx context.Context, email string, actor audit.Actor) error {
+	u, err := r.FindByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+	if u.EmailVerifiedAt == nil {
+		return ErrNotFound
+	}
+	if u.Role == user.RoleAdmin {
+		return nil
+	}
+	return changeUser(ctx, r.db, u.ID, actor, audit.ActionUpdate,
+		`UPDATE users SET role = $2, updated_at = now()
+		WHERE id = $1 AND email = $3 AND email_verified_at IS NOT NULL`,
+		user.RoleAdmin, u.Email)
+}
+
+// changeUser runs update, where $1 is the user id and args follow from $2,
+// and records it in the audit log
+func changeUser(ctx context.Context, db *sql.DB, id uuid.UUID, actor audit.Actor, action, update string, args ...interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := snapshotUser(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, update, append([]interface{}{id}, args...)...); err != nil {
+		return fmt.Errorf("failed to update user: %w", uniqueViolation(err))
+	}
+
+	if err := auditUser(ctx, tx, actor, action, id, before); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// snapshotUser returns user id as JSON for the audit log, leaving out the
+// password and MFA secrets, and locks the row for the rest of tx. It
+// returns nil when the user does not exist.
+func snapshotUser(ctx context.Context, tx *sql.Tx, id uuid.UUID) ([]byte, error) {
+	var snapshot []byte
+	err := tx.QueryRowContext(ctx,
+		`SELECT to_jsonb(u) - '{password,mfa_secret,mfa_last_counter}'::text[] FROM users u WHERE u.id = $1 FOR UPDATE`,
+		id).Scan(&snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to snapshot user: %w", err)
+	}
+	return snapshot, nil
+}
+
+// auditUser records a change of user id, comparing before with the state
+// of the user now
+func auditUser(ctx context.Context, tx *sql.Tx, actor audit.Actor, action string, id uuid.UUID, before []byte) error {
+	after, err := snapshotUser(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	return recordAudit(ctx, tx, actor, audit.Entry{
+		Action:     action,
+		EntityType: audit.EntityUser,
+		EntityID:   id.String(),
+		Before:     before,
+		After:      after,
+	})
+}
+
+// RegisterFailedLogin counts a failed login and locks the account for
+// lockout once it reaches maxFailures consecutive failures.
+func (r *userRepo) RegisterFailedLogin(ctx context.Context, id uuid.UUID, maxFailures int, lockout time.Duration) error {
+	res, err := r.db.ExecContext(ctx,
+		`UPDATE users SET failed_logins = failed_logins + 1,
+			locked_until = CASE WHEN failed_logins + 1 >= $2 THEN now() + $3 * interval '1 second' ELSE locked_until END
+		WHERE id = $1`,
+		id, maxFailures, lockout.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to register failed login: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ResetFailedLogins clears the failure counter and any lockout
+func (r *userRepo) ResetFailedLogins(ctx context.Context, id uuid.UUID) error {
+	res, err := r.db.ExecContext(ctx,
+		`UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to reset failed logins: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
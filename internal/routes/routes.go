@@ -3,43 +3,117 @@ package routes
 import (
 	"auth-register-sistem/internal/handler"
 	"auth-register-sistem/internal/middleware"
+	"auth-register-sistem/internal/model/apikey"
 	"net/http"
 )
 
-func SetupRoutes(userHandler *handler.UserHandler, stockHandler *handler.StockHandler, transactionHandler *handler.TransactionHandler) *http.ServeMux {
+func SetupRoutes(auth *middleware.Authenticator, userHandler *handler.UserHandler, stockHandler *handler.StockHandler, transactionHandler *handler.TransactionHandler, returnHandler *handler.ReturnHandler, bomHandler *handler.BOMHandler, priceListHandler *handler.PriceListHandler, reportHandler *handler.ReportHandler, apiKeyHandler *handler.APIKeyHandler, jwksHandler *handler.JWKSHandler, oidcHandler *handler.OIDCHandler, orgHandler *handler.OrgHandler, auditHandler *handler.AuditHandler) *http.ServeMux {
 	mux := http.NewServeMux()
 
+	// user wraps routes only people may call; member wraps routes on the
+	// data of the caller's organization; scoped wraps those API keys may
+	// also call when granted scope
+	user := func(next http.HandlerFunc) http.HandlerFunc {
+		return auth.Auth(middleware.RequireUser(next))
+	}
+	member := func(next http.HandlerFunc) http.HandlerFunc {
+		return user(middleware.RequireOrg(next))
+	}
+	scoped := func(scope string, next http.HandlerFunc) http.HandlerFunc {
+		return auth.Auth(middleware.RequireOrg(middleware.RequireScope(scope, next)))
+	}
+
+	// Public keys for verifying our tokens
+	mux.HandleFunc("GET /.well-known/jwks.json", jwksHandler.GetJWKS)
+
 	// User routes
-	mux.HandleFunc("/register", userHandler.Register)
-	mux.HandleFunc("/login", userHandler.Login)
-
-	// Stock routes
-	mux.HandleFunc("/stock", middleware.Auth(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			stockHandler.GetAllProducts(w, r)
-		case http.MethodPost:
-			stockHandler.CreateProduct(w, r)
-		case http.MethodPut:
-			stockHandler.UpdateProductById(w, r)
-		case http.MethodDelete:
-			stockHandler.DeleteProductById(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}))
+	mux.HandleFunc("POST /register", userHandler.Register)
+	mux.HandleFunc("POST /login", userHandler.Login)
+	mux.HandleFunc("POST /login/mfa", userHandler.LoginMFA)
+	mux.HandleFunc("GET /auth/oidc/{provider}/login", oidcHandler.Login)
+	mux.HandleFunc("GET /auth/oidc/{provider}/callback", oidcHandler.Callback)
+	mux.HandleFunc("POST /password/forgot", userHandler.ForgotPassword)
+	mux.HandleFunc("GET /password/reset", userHandler.ResetPasswordForm)
+	mux.HandleFunc("POST /password/reset", userHandler.ResetPassword)
+	mux.HandleFunc("GET /email/verify", userHandler.VerifyEmail)
+	mux.HandleFunc("POST /email/verify", userHandler.VerifyEmail)
+	mux.HandleFunc("POST /email/verify/resend", user(userHandler.ResendVerification))
+	mux.HandleFunc("GET /me", user(userHandler.Me))
+	mux.HandleFunc("GET /users", user(middleware.RequireAdmin(userHandler.ListUsers)))
+	mux.HandleFunc("GET /users/{id}", user(userHandler.GetUser))
+	mux.HandleFunc("PATCH /users/{id}", user(userHandler.UpdateUser))
+	mux.HandleFunc("POST /users/{id}/disable", user(middleware.RequireAdmin(userHandler.DisableUser)))
+	mux.HandleFunc("POST /users/{id}/enable", user(middleware.RequireAdmin(userHandler.EnableUser)))
+	mux.HandleFunc("POST /users/{id}/unlock", user(middleware.RequireAdmin(userHandler.UnlockUser)))
+	mux.HandleFunc("DELETE /users/{id}/mfa", user(middleware.RequireAdmin(userHandler.ResetMFA)))
+	mux.HandleFunc("GET /auth/attempts", user(middleware.RequireAdmin(userHandler.ListAuthAttempts)))
+
+	// Organization routes
+	mux.HandleFunc("GET /orgs", user(orgHandler.ListOrgs))
+	mux.HandleFunc("POST /orgs", user(orgHandler.CreateOrg))
+	mux.HandleFunc("POST /orgs/{id}/switch", user(orgHandler.SwitchOrg))
+	mux.HandleFunc("GET /orgs/{id}/members", user(orgHandler.ListMembers))
+	mux.HandleFunc("POST /orgs/{id}/members", user(orgHandler.AddMember))
+	mux.HandleFunc("PATCH /orgs/{id}/members/{user_id}", user(orgHandler.UpdateMember))
+	mux.HandleFunc("DELETE /orgs/{id}/members/{user_id}", user(orgHandler.RemoveMember))
+
+	// API key routes; keys belong to the caller's organization
+	mux.HandleFunc("GET /api-keys", member(middleware.RequireOrgAdmin(apiKeyHandler.ListAPIKeys)))
+	mux.HandleFunc("POST /api-keys", member(middleware.RequireOrgAdmin(apiKeyHandler.CreateAPIKey)))
+	mux.HandleFunc("DELETE /api-keys/{id}", member(middleware.RequireOrgAdmin(apiKeyHandler.RevokeAPIKey)))
+
+	// MFA routes
+	mux.HandleFunc("POST /mfa/enroll", user(userHandler.EnrollMFA))
+	mux.HandleFunc("POST /mfa/verify", user(userHandler.VerifyMFA))
+	mux.HandleFunc("POST /mfa/disable", user(userHandler.DisableMFA))
+	mux.HandleFunc("POST /mfa/recovery-codes", user(userHandler.RegenerateRecoveryCodes))
+
+	// Stock routes; deleting products requires a token issued with MFA
+	mux.HandleFunc("GET /stock", scoped(apikey.ScopeStockRead, stockHandler.GetAllProducts))
+	mux.HandleFunc("POST /stock", scoped(apikey.ScopeStockWrite, stockHandler.CreateProduct))
+	mux.HandleFunc("GET /stock/{id}", scoped(apikey.ScopeStockRead, stockHandler.GetProductById))
+	mux.HandleFunc("PUT /stock/{id}", scoped(apikey.ScopeStockWrite, stockHandler.UpdateProductById))
+	mux.HandleFunc("PATCH /stock/{id}", scoped(apikey.ScopeStockWrite, stockHandler.PatchProductById))
+	mux.HandleFunc("GET /stock/{id}/history", scoped(apikey.ScopeStockRead, stockHandler.GetHistory))
+	mux.HandleFunc("DELETE /stock/{id}", member(middleware.RequireMFA(stockHandler.DeleteProductById)))
+	mux.HandleFunc("POST /stock/{id}/restore", scoped(apikey.ScopeStockWrite, stockHandler.RestoreProductById))
+	mux.HandleFunc("POST /stock/{id}/archive", scoped(apikey.ScopeStockWrite, stockHandler.ArchiveProductById))
+	mux.HandleFunc("DELETE /stock/{id}/purge", member(middleware.RequireMFA(stockHandler.PurgeProductById)))
+	mux.HandleFunc("POST /stock/variants", scoped(apikey.ScopeStockWrite, stockHandler.CreateVariants))
+	mux.HandleFunc("GET /stock/units", scoped(apikey.ScopeStockRead, stockHandler.GetUnits))
+	mux.HandleFunc("PUT /stock/units", scoped(apikey.ScopeStockWrite, stockHandler.SetUnits))
+
+	// Legacy ?id= forms of the single-product routes
+	mux.HandleFunc("PUT /stock", scoped(apikey.ScopeStockWrite, stockHandler.UpdateProductById))
+	mux.HandleFunc("DELETE /stock", member(middleware.RequireMFA(stockHandler.DeleteProductById)))
 
 	// Transaction routes
-	mux.HandleFunc("/transaction", middleware.Auth(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodPost:
-			transactionHandler.CreateTransaction(w, r)
-		case http.MethodGet:
-			transactionHandler.GetAllTransactions(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}))
+	mux.HandleFunc("GET /transaction", scoped(apikey.ScopeTransactionRead, transactionHandler.GetAllTransactions))
+	mux.HandleFunc("POST /transaction", scoped(apikey.ScopeTransactionWrite, transactionHandler.CreateTransaction))
+
+	// Return routes
+	mux.HandleFunc("GET /return", scoped(apikey.ScopeReturnRead, returnHandler.GetAllReturns))
+	mux.HandleFunc("POST /return", scoped(apikey.ScopeReturnWrite, returnHandler.CreateReturn))
+
+	// Bill of materials routes
+	mux.HandleFunc("GET /bom", scoped(apikey.ScopeBOMRead, bomHandler.GetBOM))
+	mux.HandleFunc("PUT /bom", scoped(apikey.ScopeBOMWrite, bomHandler.SetBOM))
+	mux.HandleFunc("POST /assembly", scoped(apikey.ScopeBOMWrite, bomHandler.CreateOperation))
+	mux.HandleFunc("GET /assembly/buildable", scoped(apikey.ScopeBOMRead, bomHandler.GetBuildableQuantity))
+
+	// Pricing routes
+	mux.HandleFunc("GET /price-list", scoped(apikey.ScopePriceListRead, priceListHandler.GetAllPriceLists))
+	mux.HandleFunc("POST /price-list", scoped(apikey.ScopePriceListWrite, priceListHandler.CreatePriceList))
+	mux.HandleFunc("GET /price-list/items", scoped(apikey.ScopePriceListRead, priceListHandler.GetPrices))
+	mux.HandleFunc("PUT /price-list/items", scoped(apikey.ScopePriceListWrite, priceListHandler.SetPrices))
+
+	// Report routes
+	mux.HandleFunc("GET /report/margin", scoped(apikey.ScopeReportRead, reportHandler.GetMarginReport))
+
+	// Audit routes; only platform admins see entries outside their
+	// organization
+	mux.HandleFunc("GET /audit", user(auditHandler.ListAudit))
+	mux.HandleFunc("GET /audit/verify", user(middleware.RequireAdmin(auditHandler.VerifyAudit)))
 
 	return mux
 }